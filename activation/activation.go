@@ -0,0 +1,83 @@
+// Package activation 供被Tower运行的程序获取Tower传递过来的监听socket。
+//
+// Tower开启socket激活模式(app.socketActivation)后，会自己监听对外公开的端口，
+// 并按照systemd的LISTEN_FDS约定把监听socket传递给程序(从文件描述符3开始)。
+// 新版本程序继承同一个socket，不需要代理转发，也不需要轮换端口：
+//
+//	l, err := activation.Listen("tcp", ":8080")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	http.Serve(l, handler)
+package activation
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 第一个被传递的文件描述符(0、1、2为标准输入输出)
+const listenFdsStart = 3
+
+var ErrNoListeners = errors.New("activation: no inherited listeners")
+
+// Listeners 返回继承的所有监听socket。没有时返回nil
+func Listeners() ([]net.Listener, error) {
+	files := Files()
+	listeners := make([]net.Listener, 0, len(files))
+	for _, f := range files {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// Listen 优先使用继承的监听socket，没有时自己监听address
+func Listen(network string, address string) (net.Listener, error) {
+	listeners, err := Listeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) > 0 {
+		for _, l := range listeners[1:] {
+			l.Close()
+		}
+		return listeners[0], nil
+	}
+	return net.Listen(network, address)
+}
+
+// Files 按照LISTEN_FDS约定返回继承的文件描述符，并清除相关的环境变量以免被子进程再次继承
+func Files() []*os.File {
+	defer func() {
+		os.Unsetenv(`LISTEN_PID`)
+		os.Unsetenv(`LISTEN_FDS`)
+		os.Unsetenv(`LISTEN_FDNAMES`)
+	}()
+	if pid := os.Getenv(`LISTEN_PID`); len(pid) > 0 {
+		if p, err := strconv.Atoi(pid); err != nil || p != os.Getpid() {
+			return nil
+		}
+	}
+	n, err := strconv.Atoi(os.Getenv(`LISTEN_FDS`))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv(`LISTEN_FDNAMES`), `:`)
+	files := make([]*os.File, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		name := `LISTEN_FD_` + strconv.Itoa(fd)
+		if i := fd - listenFdsStart; i < len(names) && len(names[i]) > 0 {
+			name = names[i]
+		}
+		files = append(files, os.NewFile(uintptr(fd), name))
+	}
+	return files
+}
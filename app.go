@@ -4,14 +4,16 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"html/template"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/admpub/log"
@@ -27,49 +29,38 @@ var (
 )
 
 type App struct {
-	OfflineMode        bool
-	Cmds               map[string]*exec.Cmd
-	RunParams          []string
-	MainFile           string
-	Port               string
-	Ports              map[string]int64
-	BuildDir           string
-	Name               string
-	Root               string
-	KeyPress           bool
-	LastError          string
-	PortParamName      string //端口参数名称(用于指定应用程序监听的端口，例如：webx.exe -p 8080，这里的-p就是端口参数名)
-	SwitchToNewPort    bool
-	DisabledBuild      bool
-	BuildStart         *sync.Once
-	startErr           error
-	AppRestart         *sync.Once
-	restartErr         error
-	portBinFiles       map[string]string
-	DisabledLogRequest bool
-}
-
-type StderrCapturer struct {
-	app *App
-}
-
-func (this StderrCapturer) Write(p []byte) (n int, err error) {
-	s := string(p)
-	httpError := strings.Contains(s, HttpPanicMessage)
-
-	if httpError {
-		this.app.LastError = s
-		os.Stdout.Write([]byte("----------- Application Error -----------\n"))
-		n, err = os.Stdout.Write(p)
-		os.Stdout.Write([]byte("-----------------------------------------\n"))
-	} else {
-		n, err = os.Stdout.Write(p)
-	}
-	return
+	OfflineMode     bool
+	Cmds            map[string]*exec.Cmd //通过GetCmd、SetCmd和RunningCmds访问
+	cmdMu           sync.RWMutex
+	MainFile        string
+	Port            string
+	Ports           map[string]int64 //端口(或socket文件) => 程序启动的时间，通过portMu访问
+	BuildDir        string
+	Name            string
+	Root            string
+	KeyPress        bool
+	Errors          *ErrorLog
+	BuildError      string //最近一次编译失败的信息，编译成功后清空
+	PortParamName   string //端口参数名称(用于指定应用程序监听的端口，例如：webx.exe -p 8080，这里的-p就是端口参数名)
+	SwitchToNewPort bool
+	DisabledBuild   bool
+	BuildStart      *sync.Once
+	startErr        error
+	AppRestart      *sync.Once
+	restartErr      error
+	portBinFiles    map[string]string
+	portMu          sync.RWMutex             //保护Ports和portBinFiles
+	Type            string                   //程序类型：http(默认)、grpc或tcp
+	HealthService   string                   //gRPC健康检查的服务名称，为空时检查整个服务
+	Listener        *os.File                 //socket激活模式下传递给程序的监听socket，为nil时使用端口轮换
+	SocketDir       string                   //程序监听的Unix socket文件所在的目录，为空时使用端口
+	ConfigTemplate  string                   //配置文件模板，每个实例启动前用它生成各自的配置文件
+	settings        atomic.Pointer[Settings] //通过Settings和UseSettings访问
 }
 
 func NewApp(mainFile, port, buildDir, portParamName string) (app App) {
 	app.Cmds = make(map[string]*exec.Cmd)
+	app.Errors = NewErrorLog()
 	goPath := os.Getenv(`GOPATH`)
 	if len(goPath) > 0 && !strings.HasSuffix(mainFile, `.go`) {
 		var err error
@@ -91,16 +82,26 @@ func NewApp(mainFile, port, buildDir, portParamName string) (app App) {
 	app.BuildStart = &sync.Once{}
 	app.AppRestart = &sync.Once{}
 	app.portBinFiles = make(map[string]string)
-	app.RunParams = []string{}
 	return
 }
 
+// Module 返回应用程序所在的Go模块
+func (this *App) Module() *GoModule {
+	if mod := FindGoModule(this.Root); mod != nil {
+		return mod
+	}
+	wd, _ := os.Getwd()
+	return FindGoModule(wd)
+}
+
 func (this *App) DisabledVisitPort() bool {
-	return len(this.Port) == 0 || len(this.PortParamName) == 0
+	return len(this.Port) == 0 || !this.injectsPort() || this.Listener != nil
 }
 
 func (this *App) ParseMutiPort(port string) {
 	p := strings.Split(port, `,`)
+	this.portMu.Lock()
+	defer this.portMu.Unlock()
 	this.Ports = make(map[string]int64)
 	for _, v := range p {
 		r := strings.Split(v, `-`)
@@ -118,14 +119,53 @@ func (this *App) ParseMutiPort(port string) {
 }
 
 func (this *App) SupportMutiPort() bool {
-	return this.Ports != nil && len(this.Ports) > 1 && this.PortParamName != ``
+	if len(this.SocketDir) > 0 {
+		return this.injectsPort()
+	}
+	this.portMu.RLock()
+	n := len(this.Ports)
+	this.portMu.RUnlock()
+	return n > 1 && this.injectsPort()
+}
+
+// PortStartTime 返回port上的程序启动的时间(Unix时间戳)，没有运行过时为0
+func (this *App) PortStartTime(port string) int64 {
+	this.portMu.RLock()
+	defer this.portMu.RUnlock()
+	return this.Ports[port]
+}
+
+// portBinFile 返回port上运行的程序文件
+func (this *App) portBinFile(port string) string {
+	this.portMu.RLock()
+	defer this.portMu.RUnlock()
+	return this.portBinFiles[port]
+}
+
+// usePort 记录在port上启动的程序文件，并把port标记为使用中
+func (this *App) usePort(port string, bin string, started int64) {
+	this.portMu.Lock()
+	this.portBinFiles[port] = bin
+	if started > 0 {
+		this.Ports[port] = started
+	}
+	this.portMu.Unlock()
 }
 
 func (this *App) UseRandPort() string {
+	if len(this.SocketDir) > 0 {
+		return this.newSocket()
+	}
 	lastRunTime := make([]int64, 0)
 	lastRunPorts := make(map[int64]string, 0)
+	this.portMu.RLock()
+	ports := make(map[string]int64, len(this.Ports))
 	for port, runningTime := range this.Ports {
-		if runningTime == 0 || this.IsRunning(port) == false || isFreePort(port) {
+		ports[port] = runningTime
+	}
+	this.portMu.RUnlock()
+	for port, runningTime := range ports {
+		if runningTime == 0 || this.IsRunning(port) == false || this.IsFree(port) {
 			return port
 		}
 		lastRunTime = append(lastRunTime, runningTime)
@@ -199,18 +239,19 @@ func (this *App) Stop(port string, args ...string) {
 	}
 	log.Info("== Stopping " + this.Name)
 	cmd := this.GetCmd(port)
-	err := cmd.Process.Kill()
+	err := this.stopCmd(cmd)
 	if err != nil {
 		log.Error(err)
 	}
 	cmd = nil
+	this.cleanInstance(port)
 	if port == this.Port && this.DisabledBuild {
 		return
 	}
 	bin := this.BinFile(args...)
 	err = os.Remove(bin)
 	if err == nil {
-		this.Ports[port] = 0
+		this.releasePort(port)
 		return
 	}
 	go func() {
@@ -221,7 +262,7 @@ func (this *App) Stop(port string, args ...string) {
 				log.Error(err)
 			} else {
 				log.Info(`== Remove ` + bin + `: Success.`)
-				this.Ports[port] = 0
+				this.releasePort(port)
 				return
 			}
 		}
@@ -229,20 +270,21 @@ func (this *App) Stop(port string, args ...string) {
 }
 
 func (this *App) Clean() {
-	for port, cmd := range this.Cmds {
-		if port == this.Port || !CmdIsRunning(cmd) {
+	for port, cmd := range this.RunningCmds() {
+		if port == this.Port {
 			continue
 		}
 		log.Info("== Stopping app at port: " + port)
-		err := cmd.Process.Kill()
+		err := this.stopCmd(cmd)
 		if err != nil {
 			log.Error(err)
 		}
 		cmd = nil
-		if bin, ok := this.portBinFiles[port]; ok && bin != "" {
+		this.cleanInstance(port)
+		if bin := this.portBinFile(port); bin != "" {
 			err := os.Remove(bin)
 			if err == nil {
-				this.Ports[port] = 0
+				this.releasePort(port)
 				continue
 			}
 			go func() {
@@ -253,7 +295,7 @@ func (this *App) Clean() {
 						log.Error(err)
 					} else {
 						log.Info(`== Remove ` + bin + `: Success.`)
-						this.Ports[port] = 0
+						this.releasePort(port)
 						return
 					}
 				}
@@ -269,12 +311,29 @@ func (this *App) GetCmd(args ...string) (cmd *exec.Cmd) {
 	} else {
 		port = this.Port
 	}
+	this.cmdMu.RLock()
 	cmd, _ = this.Cmds[port]
+	this.cmdMu.RUnlock()
 	return
 }
 
 func (this *App) SetCmd(port string, cmd *exec.Cmd) {
+	this.cmdMu.Lock()
 	this.Cmds[port] = cmd
+	this.cmdMu.Unlock()
+}
+
+// RunningCmds 返回正在运行的各版本程序(端口或socket文件 => 进程)的快照
+func (this *App) RunningCmds() map[string]*exec.Cmd {
+	this.cmdMu.RLock()
+	defer this.cmdMu.RUnlock()
+	cmds := make(map[string]*exec.Cmd, len(this.Cmds))
+	for port, cmd := range this.Cmds {
+		if CmdIsRunning(cmd) {
+			cmds[port] = cmd
+		}
+	}
+	return cmds
 }
 
 func (this *App) Run(port string) (err error) {
@@ -283,6 +342,11 @@ func (this *App) Run(port string) (err error) {
 	if err != nil {
 		return
 	}
+	workDir := this.Settings().WorkDir
+	if len(workDir) > 0 {
+		// 相对路径会被当作相对于工作目录
+		bin, _ = filepath.Abs(bin)
+	}
 	ableSwitch := true
 	disabledVisitPort := this.DisabledVisitPort()
 	if !disabledVisitPort {
@@ -292,14 +356,20 @@ func (this *App) Run(port string) (err error) {
 	} else {
 		log.Info("== Running " + this.Name)
 		cmd := this.GetCmd(port)
-		bin, _ := this.portBinFiles[port]
+		bin := this.portBinFile(port)
 		if cmd != nil && len(bin) > 0 {
 			defer func() {
 				if !CmdIsRunning(cmd) {
 					return
 				}
+				if err != nil && this.Listener != nil {
+					// 新版本启动失败，继续使用旧版本
+					this.SetCmd(port, cmd)
+					this.usePort(port, bin, 0)
+					return
+				}
 				log.Info("== Stopping app: " + bin)
-				err := cmd.Process.Kill()
+				err := this.stopCmd(cmd)
 				if err != nil {
 					log.Error(err)
 				}
@@ -325,32 +395,48 @@ func (this *App) Run(port string) (err error) {
 	}
 
 	var cmd *exec.Cmd
-	this.portBinFiles[port] = bin
-	this.Ports[port] = time.Now().Unix()
-	params := []string{}
-	if !disabledVisitPort && this.SupportMutiPort() {
-		params = append(params, this.PortParamName)
-		params = append(params, port)
-	}
-	params = append(params, this.RunParams...)
-	cmd = exec.Command(bin, params...)
+	this.usePort(port, bin, time.Now().Unix())
+	if err = this.renderConfig(port); err != nil {
+		return
+	}
+	params := this.runParams(port, !disabledVisitPort && this.SupportMutiPort())
+	if this.Listener != nil {
+		cmd = socketActivationCommand(this.Listener, bin, params...)
+	} else {
+		cmd = exec.Command(bin, params...)
+	}
+	cmd.Env = this.runEnv(cmd.Env, port)
+	cmd.Dir = workDir
+	setProcessGroup(cmd)
+	trackCmd(cmd)
 	this.SetCmd(this.Port, cmd)
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = StderrCapturer{this}
-	var hasError bool
+	capturer := NewStderrCapturer(this, port)
+	cmd.Stderr = capturer
 	go func() {
 		err := cmd.Run()
-		if err != nil {
-			if this.Port == port {
-				log.Error(`== cmd.Run Error:`, err)
-			}
-			hasError = true
+		cmdExited(cmd)
+		capturer.Flush()
+		go reapProcessGroup(cmd)
+		if err != nil && this.Port == port {
+			log.Error(`== cmd.Run Error:`, err)
 		}
 	}()
 	if !disabledVisitPort {
-		err = dialAddress("127.0.0.1:"+this.Port, 60, func() bool {
-			return !hasError
-		})
+		alive := func() bool {
+			return CmdIsRunning(cmd)
+		}
+		network, address := this.BackendAddress(this.Port)
+		err = dialNetwork(network, address, 60, alive)
+		if err == nil && this.IsGRPC() {
+			err = waitGRPCServing(this, this.Port, this.HealthService, 60, alive)
+		}
+	} else if this.Listener != nil {
+		// 新旧版本共用同一个监听socket，无法通过连接端口判断新版本是否就绪
+		time.Sleep(socketReadyDelay)
+		if !CmdIsRunning(cmd) {
+			err = errors.New("App exited during startup")
+		}
 	}
 	if err == nil && ableSwitch {
 		this.SwitchToNewPort = true
@@ -371,22 +457,99 @@ func (this *App) Build() (err error) {
 	if len(out) > 0 {
 		msg := strings.Replace(string(out), "# command-line-arguments\n", "", 1)
 		log.Errorf("----------- Build Error -----------\n%s-----------------------------------", msg)
+		this.BuildError = msg
 		return errors.New(msg)
 	}
+	this.BuildError = ""
 	log.Info("== Build completed.")
 	return nil
 }
 
+// Diagnostic go build输出的一条编译错误
+type Diagnostic struct {
+	File    string       `json:"file"`
+	Line    int          `json:"line"`
+	Column  int          `json:"column,omitempty"`
+	Message string       `json:"message"`
+	URL     template.URL `json:"-"`
+}
+
+var diagnosticRegexp = regexp.MustCompile(`^(?:\./)?(.+?\.go):(\d+)(?::(\d+))?: (.+)$`)
+
+// parseBuildDiagnostics 解析“./main.go:10:5: undefined: foo”格式的编译错误
+func parseBuildDiagnostics(out string) (diagnostics []Diagnostic) {
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if matches := diagnosticRegexp.FindStringSubmatch(line); matches != nil {
+			d := Diagnostic{File: matches[1], Message: matches[4]}
+			d.Line, _ = strconv.Atoi(matches[2])
+			d.Column, _ = strconv.Atoi(matches[3])
+			diagnostics = append(diagnostics, d)
+			continue
+		}
+		// 多行错误信息的后续行以tab开头
+		if strings.HasPrefix(line, "\t") && len(diagnostics) > 0 {
+			last := &diagnostics[len(diagnostics)-1]
+			last.Message += "\n" + strings.TrimSpace(line)
+		}
+	}
+	return
+}
+
 func (this *App) IsRunning(args ...string) bool {
 	return CmdIsRunning(this.GetCmd(args...))
 }
 
+// cmdExits 已启动且尚未退出的程序 => 程序退出时关闭的通道。
+// 不读取cmd.ProcessState，因为它由运行cmd.Run()的goroutine写入
+var (
+	cmdExits   = map[*exec.Cmd]chan struct{}{}
+	cmdExitsMu sync.Mutex
+)
+
+// trackCmd 在启动程序前调用，程序退出后需要调用cmdExited
+func trackCmd(cmd *exec.Cmd) {
+	cmdExitsMu.Lock()
+	cmdExits[cmd] = make(chan struct{})
+	cmdExitsMu.Unlock()
+}
+
+// cmdExited 在cmd.Run()或cmd.Wait()返回后调用
+func cmdExited(cmd *exec.Cmd) {
+	cmdExitsMu.Lock()
+	if done, ok := cmdExits[cmd]; ok {
+		close(done)
+		delete(cmdExits, cmd)
+	}
+	cmdExitsMu.Unlock()
+}
+
+// cmdDone 返回程序退出时关闭的通道，程序已退出(或未通过trackCmd启动)时返回已关闭的通道
+func cmdDone(cmd *exec.Cmd) <-chan struct{} {
+	cmdExitsMu.Lock()
+	defer cmdExitsMu.Unlock()
+	if done, ok := cmdExits[cmd]; ok {
+		return done
+	}
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
 func CmdIsRunning(cmd *exec.Cmd) bool {
-	return cmd != nil && cmd.ProcessState == nil
+	if cmd == nil {
+		return false
+	}
+	select {
+	case <-cmdDone(cmd):
+		return false
+	default:
+		return true
+	}
 }
 
 func CmdIsQuit(cmd *exec.Cmd) bool {
-	return cmd != nil && cmd.ProcessState != nil
+	return cmd != nil && !CmdIsRunning(cmd)
 }
 
 func (this *App) IsQuit(args ...string) bool {
@@ -409,14 +572,28 @@ func (this *App) RestartOnReturn() {
 			}
 		}
 	}()
+}
 
-	// Listen to "^C" signal and stop the app properly
-	go func() {
-		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, os.Interrupt)
-		<-sig // wait for the "^C" signal
-		fmt.Println("")
-		this.Stop(this.Port)
-		os.Exit(0)
-	}()
+// StopAll 停止所有版本的程序，在Tower退出时调用
+func (this *App) StopAll() {
+	wg := sync.WaitGroup{}
+	for port, cmd := range this.RunningCmds() {
+		if port == this.Port {
+			continue
+		}
+		wg.Add(1)
+		go func(cmd *exec.Cmd) {
+			defer wg.Done()
+			this.stopCmd(cmd)
+		}(cmd)
+	}
+	this.Stop(this.Port)
+	wg.Wait()
+}
+
+// KillAll 立即结束所有版本的程序及其子进程，在Tower异常退出时调用
+func (this *App) KillAll() {
+	for _, cmd := range this.RunningCmds() {
+		killProcessGroup(cmd)
+	}
 }
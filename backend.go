@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/admpub/log"
+)
+
+// 后端程序使用Unix socket时，socket文件的扩展名
+const socketExt = ".sock"
+
+// UseSocketDir 使用dir中的Unix socket代替端口与程序通信，每个版本对应一个“tower-app-<n>.sock”。
+// 此时不再需要端口范围，端口参数(PortParamName)的值为socket文件的路径
+func (this *App) UseSocketDir(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	this.SocketDir = dir
+	this.cleanStaleSockets()
+	this.portMu.Lock()
+	this.Ports = make(map[string]int64)
+	this.portMu.Unlock()
+	this.Port = this.newSocket()
+	return nil
+}
+
+// IsSocket port是否为Unix socket文件的路径
+func (this *App) IsSocket(port string) bool {
+	return strings.HasSuffix(port, socketExt)
+}
+
+// newSocket 返回新版本程序使用的socket文件路径
+func (this *App) newSocket() string {
+	n := time.Now().Unix()
+	for {
+		file := filepath.Join(this.SocketDir, BinPrefix+strconv.FormatInt(n, 10)+socketExt)
+		this.portMu.RLock()
+		_, used := this.Ports[file]
+		this.portMu.RUnlock()
+		if !used {
+			if _, err := os.Stat(file); os.IsNotExist(err) {
+				return file
+			}
+		}
+		n++
+	}
+}
+
+// cleanStaleSockets 删除没有程序在监听的socket文件(例如Tower异常退出后遗留的)
+func (this *App) cleanStaleSockets() {
+	files, _ := filepath.Glob(filepath.Join(this.SocketDir, BinPrefix+`*`+socketExt))
+	for _, file := range files {
+		if this.IsFree(file) {
+			this.removeSocket(file)
+		}
+	}
+}
+
+// releasePort 程序退出后释放端口，socket文件则直接删除
+func (this *App) releasePort(port string) {
+	if this.IsSocket(port) {
+		this.removeSocket(port)
+		return
+	}
+	this.portMu.Lock()
+	this.Ports[port] = 0
+	this.portMu.Unlock()
+}
+
+func (this *App) removeSocket(port string) {
+	if !this.IsSocket(port) {
+		return
+	}
+	this.portMu.Lock()
+	delete(this.Ports, port)
+	this.portMu.Unlock()
+	if err := os.Remove(port); err == nil {
+		log.Info(`== Remove ` + port + `: Success.`)
+	} else if !os.IsNotExist(err) {
+		log.Error(err)
+	}
+}
+
+// BackendAddress 返回连接程序所用的网络类型和地址
+func (this *App) BackendAddress(port string) (network string, address string) {
+	if this.IsSocket(port) {
+		return `unix`, port
+	}
+	return `tcp`, `127.0.0.1:` + port
+}
+
+// BackendHost 返回转发请求时使用的主机名，由DialBackend解析为实际的地址
+func (this *App) BackendHost(port string) string {
+	if this.IsSocket(port) {
+		return strings.TrimSuffix(filepath.Base(port), socketExt)
+	}
+	return `127.0.0.1:` + port
+}
+
+// BackendURL 用于显示的程序地址
+func (this *App) BackendURL(port string) string {
+	if this.IsSocket(port) {
+		return `unix:` + port
+	}
+	return `http://localhost:` + port
+}
+
+var backendDialer = &net.Dialer{
+	Timeout:   5 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// DialBackend 连接BackendHost返回的主机
+func (this *App) DialBackend(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if len(this.SocketDir) > 0 {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		if strings.HasPrefix(host, BinPrefix) {
+			return backendDialer.DialContext(ctx, `unix`, filepath.Join(this.SocketDir, host+socketExt))
+		}
+	}
+	return backendDialer.DialContext(ctx, network, addr)
+}
+
+// IsFree 是否没有程序在port上监听
+func (this *App) IsFree(port string) bool {
+	network, address := this.BackendAddress(port)
+	conn, err := net.DialTimeout(network, address, time.Second)
+	if err != nil {
+		return true
+	}
+	conn.Close()
+	return false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixSocketBackend(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `tower-sock`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stale := filepath.Join(dir, BinPrefix+`1`+socketExt)
+	if err := ioutil.WriteFile(stale, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	app := &App{Cmds: map[string]*exec.Cmd{}, PortParamName: `-p`}
+	if err := app.UseSocketDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatal("stale socket should be removed")
+	}
+	if !app.SupportMutiPort() || !app.IsSocket(app.Port) || filepath.Dir(app.Port) != app.SocketDir {
+		t.Fatalf("unexpected socket: %s", app.Port)
+	}
+	l, err := net.Listen(`unix`, app.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`ok`))
+	}))
+	if app.IsFree(app.Port) {
+		t.Fatal("socket should be in use")
+	}
+	if next := app.UseRandPort(); next == app.Port {
+		t.Fatal("expected a new socket for the next version")
+	}
+
+	g := NewGateway(app)
+	addr, err := g.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.SetBackend(app.Port)
+	resp, err := http.Get(addr + `/`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != `ok` {
+		t.Fatalf("unexpected response: %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ErrorKindHTTP      = "http"
+	ErrorKindPanic     = "panic"
+	ErrorKindFatal     = "fatal"
+	ErrorKindRecovered = "recovered"
+	ErrorKindGoroutine = "goroutine"
+
+	// 在此时间内没有新的输出，则认为异常信息已经输出完毕
+	captureIdleTimeout = 200 * time.Millisecond
+	captureMaxSize     = 256 * 1024
+	errorLogMaxSize    = 50
+)
+
+var (
+	httpPanicRegexp = regexp.MustCompile(regexp.QuoteMeta(HttpPanicMessage) + ` (\S+): `)
+	errorStartRules = []struct {
+		Kind   string
+		Regexp *regexp.Regexp
+	}{
+		{ErrorKindHTTP, httpPanicRegexp},
+		{ErrorKindPanic, regexp.MustCompile(`^panic: `)},
+		{ErrorKindFatal, regexp.MustCompile(`^fatal error: `)},
+		// echo/webx: [PANIC RECOVER]; gin: [Recovery] ... panic recovered
+		{ErrorKindRecovered, regexp.MustCompile(`(?i)panic recover`)},
+		{ErrorKindGoroutine, regexp.MustCompile(`^goroutine \d+ \[[^\]]+\]:`)},
+	}
+)
+
+// AppError 应用程序输出到stderr的异常信息
+type AppError struct {
+	Kind       string
+	Message    string
+	Port       string
+	RemoteAddr string //仅http类型有效，格式为“127.0.0.1:54114”，即Tower连接程序时使用的本地地址
+	Time       time.Time
+	claimed    bool
+}
+
+// ErrorLog 最近捕获到的异常信息
+type ErrorLog struct {
+	mu         sync.Mutex
+	errors     []*AppError
+	collecting int //正在收集中的异常数量
+}
+
+func NewErrorLog() *ErrorLog {
+	return &ErrorLog{errors: []*AppError{}}
+}
+
+func (this *ErrorLog) begin() {
+	this.mu.Lock()
+	this.collecting++
+	this.mu.Unlock()
+}
+
+func (this *ErrorLog) Add(e *AppError) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.collecting > 0 {
+		this.collecting--
+	}
+	this.errors = append(this.errors, e)
+	if len(this.errors) > errorLogMaxSize {
+		this.errors = this.errors[len(this.errors)-errorLogMaxSize:]
+	}
+}
+
+// Wait 等待正在收集中的异常信息输出完毕，最多等待timeout
+func (this *ErrorLog) Wait(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		this.mu.Lock()
+		collecting := this.collecting
+		this.mu.Unlock()
+		if collecting == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Claim 返回端口为port的程序在since之后输出的异常，只在请求失败(5xx或没有响应)时调用。
+// http类型的异常带有请求的连接地址，只返回给使用conn连接的请求，并且只能被取走一次
+// (conn为空时无法区分，例如Unix socket，返回其中任意一个)；其它类型(框架recover的panic、
+// 程序崩溃、后台goroutine等)无法对应到特定的请求，返回给该程序上所有失败的请求但不标记为已取走
+func (this *ErrorLog) Claim(since time.Time, port string, conn string) *AppError {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	var shared *AppError
+	for _, e := range this.errors {
+		if e.Port != port || e.Time.Before(since) {
+			continue
+		}
+		switch e.Kind {
+		case ErrorKindHTTP:
+			if e.claimed || len(conn) > 0 && e.RemoteAddr != conn {
+				continue
+			}
+			e.claimed = true
+			return e
+		default:
+			if shared == nil {
+				shared = e
+			}
+		}
+	}
+	return shared
+}
+
+// StderrCapturer 逐行缓存应用程序的stderr输出，并从中识别出panic等异常信息
+type StderrCapturer struct {
+	app     *App
+	port    string
+	mu      sync.Mutex
+	pending []byte       //尚未遇到换行符的内容
+	block   bytes.Buffer //正在收集的异常信息
+	current *AppError
+	timer   *time.Timer
+}
+
+func NewStderrCapturer(app *App, port string) *StderrCapturer {
+	return &StderrCapturer{app: app, port: port}
+}
+
+func (this *StderrCapturer) Write(p []byte) (n int, err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	n, err = os.Stdout.Write(p)
+	this.pending = append(this.pending, p...)
+	for {
+		i := bytes.IndexByte(this.pending, '\n')
+		if i < 0 {
+			break
+		}
+		this.line(string(this.pending[:i]))
+		this.pending = this.pending[i+1:]
+	}
+	if this.current != nil || len(this.pending) > 0 {
+		this.resetTimer()
+	}
+	return
+}
+
+func (this *StderrCapturer) line(s string) {
+	s = strings.TrimSuffix(s, "\r")
+	if this.current == nil {
+		kind, remoteAddr := detectErrorStart(s)
+		if len(kind) == 0 {
+			return
+		}
+		this.current = &AppError{
+			Kind:       kind,
+			Port:       this.port,
+			RemoteAddr: remoteAddr,
+			Time:       time.Now(),
+		}
+		this.app.Errors.begin()
+		os.Stdout.Write([]byte("----------- Application Error -----------\n"))
+	}
+	if this.block.Len() < captureMaxSize {
+		this.block.WriteString(s)
+		this.block.WriteByte('\n')
+	}
+}
+
+func (this *StderrCapturer) resetTimer() {
+	if this.timer == nil {
+		this.timer = time.AfterFunc(captureIdleTimeout, this.Flush)
+		return
+	}
+	this.timer.Reset(captureIdleTimeout)
+}
+
+// Flush 结束当前异常信息的收集。进程退出或者一段时间内没有新输出时调用
+func (this *StderrCapturer) Flush() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if len(this.pending) > 0 {
+		this.line(string(this.pending))
+		this.pending = this.pending[:0]
+	}
+	if this.current == nil {
+		return
+	}
+	this.current.Message = this.block.String()
+	this.app.Errors.Add(this.current)
+	this.current = nil
+	this.block.Reset()
+	os.Stdout.Write([]byte("-----------------------------------------\n"))
+}
+
+func detectErrorStart(line string) (kind string, remoteAddr string) {
+	for _, rule := range errorStartRules {
+		matches := rule.Regexp.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+		kind = rule.Kind
+		if len(matches) > 1 {
+			remoteAddr = matches[1]
+		}
+		return
+	}
+	return
+}
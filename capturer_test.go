@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestErrorLogClaim(t *testing.T) {
+	log := NewErrorLog()
+	since := time.Now()
+	log.Add(&AppError{Kind: ErrorKindHTTP, Port: `5001`, RemoteAddr: `127.0.0.1:1000`, Message: `old`, Time: since.Add(-time.Second)})
+	log.Add(&AppError{Kind: ErrorKindHTTP, Port: `5002`, RemoteAddr: `127.0.0.1:1000`, Message: `other instance`, Time: since})
+	log.Add(&AppError{Kind: ErrorKindHTTP, Port: `5001`, RemoteAddr: `127.0.0.1:1001`, Message: `request 1`, Time: since})
+	log.Add(&AppError{Kind: ErrorKindHTTP, Port: `5001`, RemoteAddr: `127.0.0.1:1002`, Message: `request 2`, Time: since})
+
+	// 并发的请求只取走自己连接上的异常
+	if e := log.Claim(since, `5001`, `127.0.0.1:1002`); e == nil || e.Message != `request 2` {
+		t.Fatalf("unexpected error: %v", e)
+	}
+	if e := log.Claim(since, `5001`, `127.0.0.1:1002`); e != nil {
+		t.Fatalf("request error claimed twice: %v", e)
+	}
+	if e := log.Claim(since, `5001`, `127.0.0.1:1000`); e != nil {
+		t.Fatalf("error of another connection claimed: %v", e)
+	}
+	// 无法区分连接时(Unix socket)取走任意一个
+	if e := log.Claim(since, `5001`, ``); e == nil || e.Message != `request 1` {
+		t.Fatalf("unexpected error: %v", e)
+	}
+
+	log.Add(&AppError{Kind: ErrorKindRecovered, Port: `5001`, Message: `recovered`, Time: since})
+	for i := 0; i < 2; i++ {
+		if e := log.Claim(since, `5001`, `127.0.0.1:1003`); e == nil || e.Message != `recovered` {
+			t.Fatalf("shared error should be returned to every failed request: %v", e)
+		}
+	}
+	if e := log.Claim(since, `5003`, ``); e != nil {
+		t.Fatalf("unexpected error for another port: %v", e)
+	}
+}
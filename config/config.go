@@ -1,11 +1,6 @@
 package config
 
-var Conf = &Config{
-	App:   &App{},
-	Proxy: &Proxy{},
-	Admin: &Admin{},
-	Watch: &Watch{},
-}
+var Conf = New()
 
 type App struct {
 	ExecFile      *string `json:"exec"` //非编译模式下有效
@@ -14,11 +9,26 @@ type App struct {
 	PortParamName *string `json:"portParamName"`
 	BuildDir      *string `json:"buildDir"`
 	RunParams     *string `json:"params"`
+	Type          *string `json:"type"`          //程序类型：http、grpc或tcp
+	HealthService *string `json:"healthService"` //gRPC健康检查的服务名称
+
+	SocketActivation *bool   `json:"socketActivation"` //由Tower监听proxy.port并把socket传递给程序，不使用代理和端口轮换
+	SocketDir        *string `json:"socketDir"`        //程序监听的Unix socket文件所在的目录，为空时使用端口
+	PortEnv          *string `json:"portEnv"`          //通过环境变量传递端口，例如：“PORT”
+	ConfigTemplate   *string `json:"configTemplate"`   //配置文件模板，每个实例启动前用它生成各自的配置文件
+
+	Args    []string          `json:"args"`    //列表形式的运行参数，追加在params之后
+	Env     map[string]string `json:"env"`     //程序的环境变量，值中可以使用${VAR}
+	EnvFile *string           `json:"envFile"` //.env文件
+	WorkDir *string           `json:"workDir"` //程序的工作目录
+
+	StopSignal  *string `json:"stopSignal"`  //停止程序时发送的信号：SIGTERM、SIGINT、SIGQUIT或SIGKILL
+	StopTimeout *int    `json:"stopTimeout"` //秒。发送信号后等待程序退出的时间，超时则强制结束
 }
 
 func (a *App) Fixed() {
 	if a.ExecFile == nil {
-		s := ``
+		s := `tower-app-*.exe`
 		a.ExecFile = &s
 	}
 	if a.MainFile == nil {
@@ -26,7 +36,7 @@ func (a *App) Fixed() {
 		a.MainFile = &s
 	}
 	if a.Port == nil {
-		s := ``
+		s := `5001-5050`
 		a.Port = &s
 	}
 	if a.PortParamName == nil {
@@ -41,24 +51,158 @@ func (a *App) Fixed() {
 		s := ``
 		a.RunParams = &s
 	}
+	if a.Type == nil {
+		s := `http`
+		a.Type = &s
+	}
+	if a.HealthService == nil {
+		s := ``
+		a.HealthService = &s
+	}
+	if a.SocketActivation == nil {
+		s := false
+		a.SocketActivation = &s
+	}
+	if a.SocketDir == nil {
+		s := ``
+		a.SocketDir = &s
+	}
+	if a.PortEnv == nil {
+		s := ``
+		a.PortEnv = &s
+	}
+	if a.ConfigTemplate == nil {
+		s := ``
+		a.ConfigTemplate = &s
+	}
+	if a.EnvFile == nil {
+		s := `.env`
+		a.EnvFile = &s
+	}
+	if a.WorkDir == nil {
+		s := ``
+		a.WorkDir = &s
+	}
+	if a.StopSignal == nil {
+		s := `SIGTERM`
+		a.StopSignal = &s
+	}
+	if a.StopTimeout == nil {
+		s := 10
+		a.StopTimeout = &s
+	}
 }
 
 type Proxy struct {
-	Port   *string `json:"port"`
-	Engine *string `json:"engine"`
+	Port         *string `json:"port"`
+	Engine       *string `json:"engine"`
+	QueueSize    *int    `json:"queueSize"`
+	QueueTimeout *int    `json:"queueTimeout"` //秒
+
+	Retries           *int    `json:"retries"`           //后端连接失败时幂等请求的最多重试次数，为0时不重试
+	RetryTimeout      *int    `json:"retryTimeout"`      //每次尝试等待响应的时间(秒)，为0时不限制
+	RetryStatusCodes  *string `json:"retryStatusCodes"`  //需要重试的响应状态码，多个用半角逗号分隔，默认不重试
+	IdempotencyHeader *string `json:"idempotencyHeader"` //带有此头信息的非幂等请求(例如POST)也会重试
+
+	TLS        *TLS  `json:"tls"`
+	HTTP2      *bool `json:"http2"`      //HTTPS时支持HTTP/2
+	H2C        *bool `json:"h2c"`        //HTTP时支持h2c(不加密的HTTP/2)
+	BackendH2C *bool `json:"backendH2C"` //使用h2c连接后端程序
+
+	StreamGracePeriod *int `json:"streamGracePeriod"` //切换版本后旧版本上的WebSocket/SSE连接最多保留的时间(秒)
 }
 
 func (p *Proxy) Fixed() {
-	if p.Engine == nil {
+	if p.TLS == nil {
+		p.TLS = &TLS{}
+	}
+	p.TLS.Fixed()
+	if p.HTTP2 == nil {
+		s := true
+		p.HTTP2 = &s
+	}
+	if p.H2C == nil {
+		s := false
+		p.H2C = &s
+	}
+	if p.StreamGracePeriod == nil {
+		s := 60
+		p.StreamGracePeriod = &s
+	}
+	if p.BackendH2C == nil {
+		s := false
+		p.BackendH2C = &s
+	}
+	if p.Retries == nil {
+		s := 2
+		p.Retries = &s
+	}
+	if p.RetryTimeout == nil {
+		s := 0
+		p.RetryTimeout = &s
+	}
+	if p.RetryStatusCodes == nil {
 		s := ``
+		p.RetryStatusCodes = &s
+	}
+	if p.IdempotencyHeader == nil {
+		s := `Idempotency-Key`
+		p.IdempotencyHeader = &s
+	}
+	if p.QueueSize == nil {
+		s := 0
+		p.QueueSize = &s
+	}
+	if p.QueueTimeout == nil {
+		s := 0
+		p.QueueTimeout = &s
+	}
+	if p.Engine == nil {
+		s := `standard`
 		p.Engine = &s
 	}
 	if p.Port == nil {
-		s := ``
+		s := `8080`
 		p.Port = &s
 	}
 }
 
+type TLS struct {
+	Enabled      *bool   `json:"enabled"`
+	CertFile     *string `json:"certFile"` //为空时使用本地CA自动签发
+	KeyFile      *string `json:"keyFile"`
+	Hosts        *string `json:"hosts"`        //自动签发证书的域名，多个用半角逗号分隔
+	CADir        *string `json:"caDir"`        //本地CA的保存位置，默认为~/.tower/ca
+	RedirectPort *string `json:"redirectPort"` //在此端口上把HTTP请求重定向到HTTPS，为空时不重定向
+}
+
+func (t *TLS) Fixed() {
+	if t.Enabled == nil {
+		s := false
+		t.Enabled = &s
+	}
+	if t.CertFile == nil {
+		s := ``
+		t.CertFile = &s
+	}
+	if t.KeyFile == nil {
+		s := ``
+		t.KeyFile = &s
+	}
+	if t.Hosts == nil {
+		s := `localhost`
+		t.Hosts = &s
+	}
+	if t.CADir == nil {
+		s := ``
+		t.CADir = &s
+	}
+	if t.RedirectPort == nil {
+		s := ``
+		t.RedirectPort = &s
+	}
+}
+
 type Watch struct {
 	FileExtension *string `json:"fileExtension"`
 	OtherDir      *string `json:"otherDir"` //编译模式下有效
@@ -67,7 +211,7 @@ type Watch struct {
 
 func (w *Watch) Fixed() {
 	if w.FileExtension == nil {
-		s := ``
+		s := `go`
 		w.FileExtension = &s
 	}
 	if w.OtherDir == nil {
@@ -75,7 +219,7 @@ func (w *Watch) Fixed() {
 		w.OtherDir = &s
 	}
 	if w.IgnoredPath == nil {
-		s := ``
+		s := `/\.git`
 		w.IgnoredPath = &s
 	}
 }
@@ -91,22 +235,90 @@ func (a *Admin) Fixed() {
 		a.Password = &s
 	}
 	if a.IPs == nil {
-		s := ``
+		s := `127.0.0.1,::1`
 		a.IPs = &s
 	}
 }
 
+type Capture struct {
+	Enabled     *bool  `json:"enabled"`
+	MaxBodySize *int64 `json:"maxBodySize"`
+	MaxRequests *int   `json:"maxRequests"`
+}
+
+func (c *Capture) Fixed() {
+	if c.Enabled == nil {
+		s := false
+		c.Enabled = &s
+	}
+	if c.MaxBodySize == nil {
+		var s int64
+		c.MaxBodySize = &s
+	}
+	if c.MaxRequests == nil {
+		s := 0
+		c.MaxRequests = &s
+	}
+}
+
+type Page struct {
+	SnippetLines *int    `json:"snippetLines"`
+	TemplateDir  *string `json:"templateDir"`
+	Theme        *string `json:"theme"`
+}
+
+func (p *Page) Fixed() {
+	if p.TemplateDir == nil {
+		s := ``
+		p.TemplateDir = &s
+	}
+	if p.Theme == nil {
+		s := ``
+		p.Theme = &s
+	}
+	if p.SnippetLines == nil {
+		s := 0
+		p.SnippetLines = &s
+	}
+}
+
+type Maintenance struct {
+	Message    *string `json:"message"`
+	RetryAfter *int    `json:"retryAfter"`
+	StateFile  *string `json:"stateFile"`
+}
+
+func (m *Maintenance) Fixed() {
+	if m.Message == nil {
+		s := ``
+		m.Message = &s
+	}
+	if m.RetryAfter == nil {
+		s := 0
+		m.RetryAfter = &s
+	}
+	if m.StateFile == nil {
+		s := ``
+		m.StateFile = &s
+	}
+}
+
 type Config struct {
-	App        *App    `json:"app"`
-	Proxy      *Proxy  `json:"proxy"`
-	Admin      *Admin  `json:"admin"`
-	Watch      *Watch  `json:"watch"`
-	Verbose    *bool   `json:"verbose"`
-	ConfigFile *string `json:"-"`
-	LogLevel   *string `json:"logLevel"`
-	LogRequest *bool   `json:"logRequest"`
-	AutoClear  *bool   `json:"autoClear"`
-	Offline    *bool   `json:"offline"`
+	App         *App              `json:"app"`
+	Proxy       *Proxy            `json:"proxy"`
+	Admin       *Admin            `json:"admin"`
+	Watch       *Watch            `json:"watch"`
+	Capture     *Capture          `json:"capture"`
+	Page        *Page             `json:"page"`
+	Maintenance *Maintenance      `json:"maintenance"`
+	Verbose     *bool             `json:"verbose"`
+	ConfigFile  *string           `json:"-"`
+	Sources     map[string]string `json:"-"` //各设置的来源，见Source
+	LogLevel    *string           `json:"logLevel"`
+	Editor      *string           `json:"editor"`
+	LogRequest  *bool             `json:"logRequest"`
+	AutoClear   *bool             `json:"autoClear"`
+	Offline     *bool             `json:"offline"`
 }
 
 func (c *Config) Fixed() {
@@ -130,28 +342,47 @@ func (c *Config) Fixed() {
 	}
 	c.Watch.Fixed()
 
+	if c.Capture == nil {
+		c.Capture = &Capture{}
+	}
+	c.Capture.Fixed()
+
+	if c.Page == nil {
+		c.Page = &Page{}
+	}
+	c.Page.Fixed()
+
+	if c.Maintenance == nil {
+		c.Maintenance = &Maintenance{}
+	}
+	c.Maintenance.Fixed()
+
 	if c.ConfigFile == nil {
 		s := ``
 		c.ConfigFile = &s
 	}
 	if c.LogLevel == nil {
-		s := ``
+		s := `Debug`
 		c.LogLevel = &s
 	}
+	if c.Editor == nil {
+		s := ``
+		c.Editor = &s
+	}
 	if c.Verbose == nil {
 		s := false
 		c.Verbose = &s
 	}
 	if c.LogRequest == nil {
-		s := false
+		s := true
 		c.LogRequest = &s
 	}
 	if c.AutoClear == nil {
-		s := false
+		s := true
 		c.AutoClear = &s
 	}
 	if c.Offline == nil {
-		s := false
+		s := true
 		c.Offline = &s
 	}
 }
@@ -0,0 +1,206 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// 配置的来源，优先级从低到高
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+// EnvPrefix 环境变量前缀。例如：app.portParamName => TOWER_APP_PORT_PARAM_NAME
+const EnvPrefix = "TOWER_"
+
+// New 返回所有设置都为nil的配置
+func New() *Config {
+	return &Config{
+		App:         &App{},
+		Proxy:       &Proxy{},
+		Admin:       &Admin{},
+		Watch:       &Watch{},
+		Capture:     &Capture{},
+		Page:        &Page{},
+		Maintenance: &Maintenance{},
+	}
+}
+
+// Keys 返回所有设置的名称，例如：app.port、proxy.tls.certFile
+func Keys() []string {
+	var keys []string
+	walkFields(reflect.ValueOf(New()).Elem(), ``, func(key string, _ reflect.Value) {
+		keys = append(keys, key)
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// EnvName 返回设置对应的环境变量名称
+func EnvName(key string) string {
+	var b strings.Builder
+	b.WriteString(EnvPrefix)
+	prev := rune(0)
+	for _, r := range key {
+		switch {
+		case r == '.':
+			b.WriteRune('_')
+		case unicode.IsUpper(r) && unicode.IsLower(prev):
+			b.WriteRune('_')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(unicode.ToUpper(r))
+		}
+		prev = r
+	}
+	return b.String()
+}
+
+// Merge 把src中不为nil的设置复制到c，并记录其来源，返回被设置的名称
+func (c *Config) Merge(src *Config, source string) []string {
+	values := map[string]reflect.Value{}
+	walkFields(reflect.ValueOf(src).Elem(), ``, func(key string, v reflect.Value) {
+		if !v.IsNil() {
+			values[key] = v
+		}
+	})
+	var keys []string
+	walkFields(reflect.ValueOf(c).Elem(), ``, func(key string, v reflect.Value) {
+		if value, ok := values[key]; ok {
+			v.Set(value)
+			c.setSource(key, source)
+			keys = append(keys, key)
+		}
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// Set 用字符串设置名称为key的设置。列表以半角逗号分隔，键值对的格式为“KEY=VALUE,KEY2=VALUE2”
+func (c *Config) Set(key string, value string, source string) (err error) {
+	found := false
+	walkFields(reflect.ValueOf(c).Elem(), ``, func(k string, v reflect.Value) {
+		if k != key || found {
+			return
+		}
+		found = true
+		err = setValue(v, value)
+	})
+	if !found {
+		return errors.New(`unknown setting: ` + key)
+	}
+	if err != nil {
+		return errors.New(key + `: ` + err.Error())
+	}
+	c.setSource(key, source)
+	return nil
+}
+
+// LoadEnv 从环境变量(“KEY=VALUE”的列表，一般为os.Environ())中读取TOWER_*设置
+func (c *Config) LoadEnv(environ []string) error {
+	vars := map[string]string{}
+	for _, item := range environ {
+		if pos := strings.Index(item, `=`); pos > 0 && strings.HasPrefix(item, EnvPrefix) {
+			vars[item[:pos]] = item[pos+1:]
+		}
+	}
+	for _, key := range Keys() {
+		name := EnvName(key)
+		value, ok := vars[name]
+		if !ok {
+			continue
+		}
+		if err := c.Set(key, value, SourceEnv+` `+name); err != nil {
+			return errors.New(name + `: ` + err.Error())
+		}
+	}
+	return nil
+}
+
+// Source 返回设置的来源，没有记录时为默认值
+func (c *Config) Source(key string) string {
+	if source, ok := c.Sources[key]; ok {
+		return source
+	}
+	return SourceDefault
+}
+
+func (c *Config) setSource(key string, source string) {
+	if c.Sources == nil {
+		c.Sources = map[string]string{}
+	}
+	c.Sources[key] = source
+}
+
+// walkFields 遍历v中所有带json标签的设置，fn的参数为设置的名称和值(指针、切片或map)
+func walkFields(v reflect.Value, prefix string, fn func(string, reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get(`json`), `,`)[0]
+		if len(name) == 0 || name == `-` {
+			continue
+		}
+		key := prefix + name
+		fv := v.Field(i)
+		if field.Type.Kind() == reflect.Ptr && field.Type.Elem().Kind() == reflect.Struct {
+			if fv.IsNil() {
+				fv.Set(reflect.New(field.Type.Elem()))
+			}
+			walkFields(fv.Elem(), key+`.`, fn)
+			continue
+		}
+		fn(key, fv)
+	}
+}
+
+func setValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(value, `,`) {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+		return nil
+	case reflect.Map:
+		m := map[string]string{}
+		for _, item := range strings.Split(value, `,`) {
+			if pos := strings.Index(item, `=`); pos > 0 {
+				m[strings.TrimSpace(item[:pos])] = item[pos+1:]
+			}
+		}
+		v.Set(reflect.ValueOf(m))
+		return nil
+	}
+	ptr := reflect.New(v.Type().Elem())
+	switch ptr.Elem().Kind() {
+	case reflect.String:
+		ptr.Elem().SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		ptr.Elem().SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		ptr.Elem().SetInt(i)
+	default:
+		return errors.New(`unsupported type ` + v.Type().String())
+	}
+	v.Set(ptr)
+	return nil
+}
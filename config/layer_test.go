@@ -0,0 +1,62 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEnvName(t *testing.T) {
+	for key, name := range map[string]string{
+		`app.portParamName`:  `TOWER_APP_PORT_PARAM_NAME`,
+		`proxy.tls.certFile`: `TOWER_PROXY_TLS_CERT_FILE`,
+		`proxy.backendH2C`:   `TOWER_PROXY_BACKEND_H2C`,
+		`logLevel`:           `TOWER_LOG_LEVEL`,
+	} {
+		if n := EnvName(key); n != name {
+			t.Errorf("%s: expected %s, got %s", key, name, n)
+		}
+	}
+}
+
+func TestLayers(t *testing.T) {
+	port, level := `5001-5010`, `Info`
+	file := New()
+	file.App.Port = &port
+	file.LogLevel = &level
+	file.App.Env = map[string]string{`A`: `1`}
+
+	conf := New()
+	conf.Merge(file, SourceFile)
+	err := conf.LoadEnv([]string{`TOWER_APP_PORT=6001-6010`, `TOWER_PROXY_RETRIES=3`, `TOWER_APP_ARGS=-a, -b`, `PATH=/bin`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = conf.Set(`app.port`, `7001`, SourceFlag+` -p`); err != nil {
+		t.Fatal(err)
+	}
+	conf.Fixed()
+
+	if *conf.App.Port != `7001` || *conf.Proxy.Retries != 3 || *conf.LogLevel != `Info` || *conf.Proxy.Engine != `standard` {
+		t.Fatalf("unexpected config: %v %v %v %v", *conf.App.Port, *conf.Proxy.Retries, *conf.LogLevel, *conf.Proxy.Engine)
+	}
+	if !reflect.DeepEqual(conf.App.Args, []string{`-a`, `-b`}) || conf.App.Env[`A`] != `1` {
+		t.Fatalf("unexpected app: %q %q", conf.App.Args, conf.App.Env)
+	}
+	for key, source := range map[string]string{
+		`app.port`:      `flag -p`,
+		`proxy.retries`: `env TOWER_PROXY_RETRIES`,
+		`logLevel`:      SourceFile,
+		`proxy.engine`:  SourceDefault,
+	} {
+		if s := conf.Source(key); s != source {
+			t.Errorf("%s: expected source %q, got %q", key, source, s)
+		}
+	}
+
+	if err = conf.LoadEnv([]string{`TOWER_PROXY_RETRIES=x`}); err == nil {
+		t.Fatal(`expected an error for an invalid number`)
+	}
+	if err = conf.Set(`app.unknown`, `x`, SourceFlag); err == nil {
+		t.Fatal(`expected an error for an unknown setting`)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Context 各引擎的请求上下文(包括reverseproxy.Context)都具有的方法
+type Context interface {
+	SetHeader(string, string)
+	SetBody([]byte)
+	SetStatusCode(int)
+	RemoteAddr() string
+	RequestPath() string
+	QueryValue(string) string
+}
+
+// 各引擎的Context能提供的请求信息不尽相同，以下函数通过可选接口来获取，
+// 不支持时返回零值。
+
+type httpRequestGetter interface {
+	Request() *http.Request
+}
+
+func requestOf(ctx Context) *http.Request {
+	if v, ok := ctx.(httpRequestGetter); ok {
+		return v.Request()
+	}
+	return nil
+}
+
+func requestMethod(ctx Context) string {
+	switch v := ctx.(type) {
+	case interface{ Method() string }:
+		return v.Method()
+	case interface{ RequestMethod() string }:
+		return v.RequestMethod()
+	}
+	if r := requestOf(ctx); r != nil {
+		return r.Method
+	}
+	return ""
+}
+
+func requestURI(ctx Context) string {
+	switch v := ctx.(type) {
+	case interface{ RequestURI() string }:
+		return v.RequestURI()
+	}
+	if r := requestOf(ctx); r != nil {
+		return r.URL.RequestURI()
+	}
+	return ctx.RequestPath()
+}
+
+func requestHost(ctx Context) string {
+	if r := requestOf(ctx); r != nil {
+		return r.Host
+	}
+	return requestHeader(ctx, `Host`)
+}
+
+func requestHeader(ctx Context, name string) string {
+	switch v := ctx.(type) {
+	case interface{ RequestHeader(string) string }:
+		return v.RequestHeader(name)
+	}
+	if r := requestOf(ctx); r != nil {
+		return r.Header.Get(name)
+	}
+	return ""
+}
+
+func requestHeaders(ctx Context) http.Header {
+	switch v := ctx.(type) {
+	case interface{ RequestHeaders() http.Header }:
+		return v.RequestHeaders()
+	}
+	if r := requestOf(ctx); r != nil {
+		return r.Header
+	}
+	return http.Header{}
+}
+
+// requestBody 读取最多limit字节的请求内容，并保证后续转发时请求内容依然完整
+func requestBody(ctx Context, limit int64) (body []byte, truncated bool) {
+	switch v := ctx.(type) {
+	case interface{ RequestBody() []byte }:
+		body = v.RequestBody()
+	default:
+		r := requestOf(ctx)
+		if r == nil || r.Body == nil {
+			return
+		}
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+		if err != nil {
+			return
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	}
+	if int64(len(body)) > limit {
+		body = body[:limit]
+		truncated = true
+	}
+	return
+}
@@ -6,6 +6,7 @@ import (
 )
 
 var defaultConfig = []byte(`
+# 优先级：默认值 < 本文件 < TOWER_*环境变量(例如TOWER_APP_PORT) < 命令行参数
 app {
   # 生产环境下的可执行文件。支持用“*”代替文件名的一部分，例如："tower-app-*.exe"
   exec : "tower-app-*.exe"
@@ -22,16 +23,118 @@ app {
   # go build -o 命令生成的二进制文件保存位置
   buildDir : ""
 
-  # 运行app所需的其它参数，例如：webx.exe -p 8080 -e 90 -d 100 其中的“-e 90 -d 100”就是(注意：内部用[单个]半角空格隔开)。
+  # 运行app所需的其它参数，例如：webx.exe -p 8080 -e 90 -d 100 其中的“-e 90 -d 100”就是。
+  # 按照shell的规则拆分，包含空格的参数可以用引号括起来，例如：-c "my config.yaml"
+  # 参数中可以使用占位符：{{port}}(端口)、{{addr}}(监听地址，例如127.0.0.1:5001)和{{config}}(由configTemplate生成的配置文件)，
+  # 例如："--addr={{addr}}"。这样就不需要portParamName
   params : ""
+
+  # 通过环境变量把端口传递给app，多个用半角逗号分隔。每一项为变量名(值为端口)或“变量名=值”(值中可以使用上面的占位符)，
+  # 例如："PORT,ADDR=127.0.0.1:{{port}}"
+  portEnv : ""
+
+  # 配置文件模板。每个app实例启动前，Tower会替换其中的占位符，在模板所在目录生成各自的配置文件，
+  # 例如模板“config.yaml.tpl”生成“tower-app-5001.yaml”，并在实例关闭后删除。
+  # 配置文件的路径可以通过params或portEnv中的{{config}}传递给app
+  configTemplate : ""
+
+  # 列表形式的运行参数，追加在params之后，每一项就是一个参数(不需要引号)，例如：["-c", "my config.yaml"]
+  args : []
+
+  # app的环境变量，会追加在Tower自身的环境变量之后。值中可以使用${VAR}引用envFile中的变量或Tower的环境变量，
+  # 也可以使用params中的占位符，例如：
+  # env {
+  #   DATABASE_URL : "postgres://${DB_USER}@localhost/app"
+  #   ADDR : "127.0.0.1:{{port}}"
+  # }
+  env {}
+
+  # .env文件，每行一个“KEY=VALUE”，文件不存在时忽略
+  envFile : ".env"
+
+  # app的工作目录，为空时与Tower相同
+  workDir : ""
+
+  # 停止app时发送给其进程组的信号，支持SIGTERM、SIGINT、SIGQUIT和SIGKILL(Windows上总是直接结束)
+  stopSignal : "SIGTERM"
+
+  # 发送stopSignal后等待app退出的秒数，超时则强制结束。为0时直接结束
+  stopTimeout : 10
+
+  # 程序类型。支持http、grpc和tcp。
+  # grpc类型的程序通过HTTP/2(h2c)转发(需要使用tower引擎)，并在切换版本前用grpc.health.v1检查新版本是否就绪；
+  # tcp类型的程序(自定义协议、Redis兼容服务等)只在四层转发连接，不支持HTTPS和错误页面
+  type : "http"
+
+  # gRPC健康检查的服务名称，为空时检查整个服务
+  healthService : ""
+
+  # socket激活模式(不支持Windows)。由Tower监听proxy.port，并按照systemd的LISTEN_FDS约定把socket传递给程序，
+  # 新版本继承同一个socket，不经过代理转发，也不需要端口参数和端口范围。
+  # 程序可以使用github.com/webx-top/tower/activation包获取继承的socket
+  socketActivation : false
+
+  # 使用Unix socket代替端口与程序通信(不支持Windows)。每个版本监听此目录中的“tower-app-<n>.sock”，
+  # socket文件的路径通过portParamName传递给程序，不再需要端口范围(port)，也不会有端口冲突。
+  # 旧版本关闭后其socket文件会与二进制文件一起删除。为空时使用端口
+  socketDir : ""
 }
 
 proxy {
   # 你的项目对外公开访问的端口
   port : "8080"
 
-  # 代理引擎。支持fast和standard
+  # 代理引擎。支持fast、standard和tower(内置引擎，支持HTTPS)
   engine : "standard"
+
+  # 程序重启或编译期间最多排队等待的请求数量，超出时返回503错误页面
+  queueSize : 1000
+
+  # 请求排队等待程序启动的最长时间(秒)，超时后返回503错误页面
+  queueTimeout : 60
+
+  # 后端连接失败时(例如旧版本程序已退出)，将幂等请求(GET/HEAD/OPTIONS)重试到其它可用的后端
+  # 最多重试次数，为0时不重试
+  retries : 2
+
+  # 每次尝试等待响应的时间(秒)，为0时不限制
+  retryTimeout : 0
+
+  # 后端返回这些状态码时也会重试，多个用半角逗号分隔，例如："502,503,504"。默认只重试连接失败的请求
+  retryStatusCodes : ""
+
+  # 带有此头信息的非幂等请求(例如POST)也会重试
+  idempotencyHeader : "Idempotency-Key"
+
+  # HTTPS设置(仅支持tower引擎)
+  tls {
+    enabled : false
+
+    # 证书文件。为空时使用本地CA自动签发证书(首次运行时生成CA，需要手动添加到信任列表中)
+    certFile : ""
+    keyFile : ""
+
+    # 自动签发证书的域名，多个用半角逗号分隔
+    hosts : "localhost"
+
+    # 本地CA的保存位置，为空时为~/.tower/ca
+    caDir : ""
+
+    # 在此端口上把HTTP请求重定向到HTTPS，为空时不重定向
+    redirectPort : ""
+  }
+
+  # HTTPS时支持HTTP/2(仅支持tower引擎)
+  http2 : true
+
+  # HTTP时支持h2c，即不加密的HTTP/2(仅支持tower引擎)
+  h2c : false
+
+  # 使用h2c连接你的程序(程序需要支持h2c，例如gRPC服务)
+  backendH2C : false
+
+  # 切换到新版本后，旧版本上的WebSocket/SSE连接最多保留的时间(秒)，超时后关闭旧版本程序
+  streamGracePeriod : 60
 }
 
 admin {
@@ -39,6 +142,41 @@ admin {
   ips : "127.0.0.1,::1"
 }
 
+page {
+  # 错误页面中每段源码显示的行数
+  snippetLines : 13
+
+  # 自定义页面模板所在文件夹。文件夹中可以放置 build.html(编译错误)、app_error.html(程序异常)、
+  # app_down.html(程序退出)、maintenance.html(维护页面)，缺少的页面会使用 page.html 或默认模板。
+  # 模板文件被修改后会自动重新载入
+  templateDir : ""
+
+  # 默认模板的配色。支持auto(跟随系统)/light/dark
+  theme : "auto"
+}
+
+maintenance {
+  # 维护页面显示的信息。通过 /tower-proxy/maintenance/on 和 /tower-proxy/maintenance/off 开启或关闭维护模式
+  message : ""
+
+  # 维护页面返回的Retry-After(秒)
+  retryAfter : 300
+
+  # 维护模式状态的保存位置，Tower重启后依然有效
+  stateFile : ".tower-maintenance.json"
+}
+
+capture {
+  # 是否记录出错(5xx或panic)的请求，以便修复后在管理页面 /tower-proxy/requests 中重放
+  enabled : false
+
+  # 记录的请求内容最大字节数，超出时将被截断且不能重放
+  maxBodySize : 65536
+
+  # 最多保留的请求数量
+  maxRequests : 20
+}
+
 watch {
   # 要监控更改的文件扩展名。多个扩展名时使用"|"隔开，例如：go|html
   fileExtension : "go"
@@ -56,6 +194,10 @@ verbose : false
 # 日志等级。支持的值有Debug/Info/Warn/Error/Fatal
 logLevel : "Debug"
 
+# 错误页面中点击文件时打开的编辑器。支持vscode/vscodium/idea/goland/subl/atom/emacs，
+# 也可以指定自定义链接模板，其中{path}为文件绝对路径，{line}为行号，例如："myeditor://open?file={path}&line={line}"
+editor : ""
+
 # 是否在控制台显示request日志
 logRequest : true
 
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"html/template"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// 内置的编辑器链接模板。{path}为以“/”开头的文件绝对路径(Windows下为“/C:/...”)，{line}为行号
+var editorURLTemplates = map[string]string{
+	"vscode":   "vscode://file{path}:{line}",
+	"vscodium": "vscodium://file{path}:{line}",
+	"idea":     "idea://open?file={path}&line={line}",
+	"goland":   "goland://open?file={path}&line={line}",
+	"subl":     "subl://open?url=file://{path}&line={line}",
+	"atom":     "atom://core/open/file?filename={path}&line={line}",
+	"emacs":    "emacs://open?url=file://{path}&line={line}",
+}
+
+// EditorURLTemplate 错误页面中文件链接所使用的模板，为空时不生成链接
+var EditorURLTemplate string
+
+// SetEditor 设置编辑器。支持内置的编辑器名称或者包含{path}的自定义模板
+func SetEditor(editor string) {
+	if tmpl, ok := editorURLTemplates[strings.ToLower(editor)]; ok {
+		EditorURLTemplate = tmpl
+		return
+	}
+	EditorURLTemplate = editor
+}
+
+// EditorURL 生成在编辑器中打开文件指定行的链接
+func EditorURL(mod *GoModule, file string, line int) template.URL {
+	if len(EditorURLTemplate) == 0 || len(file) == 0 {
+		return ""
+	}
+	segments := strings.Split(filepath.ToSlash(absEditorPath(mod, file)), "/")
+	for i, segment := range segments {
+		segments[i] = strings.Replace(url.PathEscape(segment), "&", "%26", -1)
+	}
+	path := strings.Join(segments, "/")
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	r := strings.NewReplacer("{path}", path, "{line}", strconv.Itoa(line))
+	return template.URL(r.Replace(EditorURLTemplate))
+}
+
+func absEditorPath(mod *GoModule, file string) string {
+	if filepath.IsAbs(file) || (len(file) > 1 && file[1] == ':') {
+		return file
+	}
+	if mod != nil {
+		if file = mod.Abs(file); filepath.IsAbs(file) {
+			return file
+		}
+		return filepath.Join(filepath.FromSlash(mod.Dir), file)
+	}
+	abs, _ := filepath.Abs(file)
+	return abs
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var errUnterminatedQuote = errors.New("== Unterminated quote in params")
+
+// splitShellWords 按照shell的规则拆分参数：支持单引号、双引号和反斜杠转义，
+// 例如：`-c "my config.yaml" --name='a b'` => [-c, my config.yaml, --name=a b]
+func splitShellWords(s string) ([]string, error) {
+	var (
+		words   []string
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+	for _, c := range s {
+		switch {
+		case escaped:
+			if quote == '"' && !strings.ContainsRune("\"\\$`\n", c) {
+				word.WriteRune('\\')
+			}
+			if c != '\n' {
+				word.WriteRune(c)
+			}
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\\':
+			escaped = true
+			inWord = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case unicode.IsSpace(c):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errUnterminatedQuote
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// loadEnvFile 读取.env文件中的环境变量，文件不存在时返回空。
+// 每行一个“KEY=VALUE”(可以带export前缀)，“#”开头的行为注释，
+// 值可以用引号括起来，不在单引号中的${VAR}会被替换
+func loadEnvFile(file string, vars map[string]string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, `#`) {
+			continue
+		}
+		line = strings.TrimPrefix(line, `export `)
+		pos := strings.Index(line, `=`)
+		if pos < 1 {
+			continue
+		}
+		key := strings.TrimSpace(line[:pos])
+		value := strings.TrimSpace(line[pos+1:])
+		if n := len(value); n > 1 && value[0] == '\'' && value[n-1] == '\'' {
+			vars[key] = value[1 : n-1]
+			continue
+		}
+		if n := len(value); n > 1 && value[0] == '"' && value[n-1] == '"' {
+			value = strings.NewReplacer(`\n`, "\n", `\"`, `"`, `\\`, `\`).Replace(value[1 : n-1])
+		} else if pos := strings.Index(value, ` #`); pos >= 0 {
+			value = strings.TrimSpace(value[:pos])
+		}
+		vars[key] = expandEnv(value, vars)
+	}
+	return scanner.Err()
+}
+
+// expandEnv 替换value中的${VAR}和$VAR，先在vars中查找，找不到时使用Tower自身的环境变量
+func expandEnv(value string, vars map[string]string) string {
+	return os.Expand(value, func(key string) string {
+		if v, ok := vars[key]; ok {
+			return v
+		}
+		return os.Getenv(key)
+	})
+}
+
+// LoadAppEnv 合并.env文件和配置文件中的env，返回传递给程序的环境变量(“KEY=VALUE”)。
+// env中的值可以引用.env文件中的变量和Tower自身的环境变量
+func LoadAppEnv(envFile string, env map[string]string) ([]string, error) {
+	vars := map[string]string{}
+	if len(envFile) > 0 {
+		if err := loadEnvFile(envFile, vars); err != nil {
+			return nil, err
+		}
+	}
+	fileVars := make(map[string]string, len(vars))
+	for key, value := range vars {
+		fileVars[key] = value
+	}
+	for key, value := range env {
+		vars[key] = expandEnv(value, fileVars)
+	}
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]string, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, key+`=`+vars[key])
+	}
+	return result, nil
+}
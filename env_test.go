@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitShellWords(t *testing.T) {
+	words, err := splitShellWords(`-c "my config.yaml" --name='a b' path\ with\ space "say \"hi\" \d" ''`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{`-c`, `my config.yaml`, `--name=a b`, `path with space`, `say "hi" \d`, ``}
+	if !reflect.DeepEqual(words, expected) {
+		t.Fatalf("unexpected words: %q", words)
+	}
+	if _, err := splitShellWords(`-c "unterminated`); err != errUnterminatedQuote {
+		t.Fatalf("expected unterminated quote error, got %v", err)
+	}
+}
+
+func TestLoadAppEnv(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `tower-env`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, `.env`)
+	content := "# comment\nexport DB_USER=admin\nDB_HOST=\"local host\"\nRAW='${DB_USER}'\nURL=${DB_USER}@${DB_HOST} # comment\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(`TOWER_TEST_ENV`, `x`)
+	defer os.Unsetenv(`TOWER_TEST_ENV`)
+	env, err := LoadAppEnv(file, map[string]string{`DSN`: `${DB_USER}:${TOWER_TEST_ENV}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{`DB_HOST=local host`, `DB_USER=admin`, `DSN=admin:x`, `RAW=${DB_USER}`, `URL=admin@local host`}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("unexpected env: %q", env)
+	}
+	if env, err = LoadAppEnv(filepath.Join(dir, `missing`), nil); err != nil || len(env) != 0 {
+		t.Fatalf("missing .env should be ignored: %v %v", env, err)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/admpub/confl"
+	c "github.com/webx-top/tower/config"
+	"gopkg.in/yaml.v2"
+)
+
+// 配置文件的格式
+const (
+	FormatConfl = `confl` //nginx风格，例如：app { port : "5001-5050" }
+	FormatYAML  = `yaml`
+	FormatTOML  = `toml`
+	FormatJSON  = `json`
+)
+
+// SchemaName tower init生成的JSON Schema文件，供编辑器检查YAML、TOML和JSON格式的配置文件
+const SchemaName = "tower.schema.json"
+
+var configFormats = []string{FormatConfl, FormatYAML, FormatTOML, FormatJSON}
+
+// configFileNames 各格式的配置文件名。没有用-c指定配置文件时按此顺序查找
+var configFileNames = map[string]string{
+	FormatConfl: ConfigName,
+	FormatYAML:  ConfigName,
+	FormatTOML:  `tower.toml`,
+	FormatJSON:  `tower.json`,
+}
+
+// errOldConfigFormat 旧格式(没有分组)的配置文件，需要用convertOldConfigFormat转换
+var errOldConfigFormat = errors.New(`old config format`)
+
+var (
+	conflSectionRegex = regexp.MustCompile(`^[\w.-]+\s*[:=]?\s*\{$`)
+	tomlTableRegex    = regexp.MustCompile(`^\[\s*([\w.-]+)\s*\]$`)
+)
+
+// ParseConfigFormat 检查格式名称，“yml”等同于“yaml”
+func ParseConfigFormat(format string) (string, error) {
+	format = strings.ToLower(format)
+	if format == `yml` {
+		format = FormatYAML
+	}
+	for _, f := range configFormats {
+		if f == format {
+			return format, nil
+		}
+	}
+	return ``, fmt.Errorf(`unsupported config format %q (%s)`, format, strings.Join(configFormats, `/`))
+}
+
+// DetectConfigFormat 根据扩展名和内容判断配置文件的格式。
+// 因为以前的tower.yml实际上是confl格式，所以.yml/.yaml文件中有“section {”这样的分组时仍按confl处理
+func DetectConfigFormat(file string, content []byte) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case `.json`:
+		return FormatJSON
+	case `.toml`:
+		return FormatTOML
+	case `.conf`, `.confl`:
+		return FormatConfl
+	case `.yml`, `.yaml`:
+		if looksLikeConfl(content) {
+			return FormatConfl
+		}
+		return FormatYAML
+	}
+	trimmed := bytes.TrimSpace(content)
+	if bytes.HasPrefix(trimmed, []byte(`{`)) {
+		return FormatJSON
+	}
+	if looksLikeConfl(content) {
+		return FormatConfl
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if tomlTableRegex.MatchString(strings.TrimSpace(line)) {
+			return FormatTOML
+		}
+	}
+	return FormatConfl
+}
+
+// looksLikeConfl 是否包含用大括号表示的分组
+func looksLikeConfl(content []byte) bool {
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, `#`) {
+			continue
+		}
+		if line == `}` || conflSectionRegex.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeConfigFile 按格式读取配置文件。YAML、TOML和JSON格式使用与confl相同的名称(json标签)。
+// 语法错误等以ConfigError的形式返回
+func decodeConfigFile(file string, conf *c.Config) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return configFileError(file, content, decodeConfigContent(file, content, conf))
+}
+
+func decodeConfigContent(file string, content []byte, conf *c.Config) (err error) {
+	var data interface{}
+	switch DetectConfigFormat(file, content) {
+	case FormatConfl:
+		_, err = confl.Decode(string(content), conf)
+		if err != nil && strings.HasSuffix(err.Error(), `. Expected map but found 'string'.`) {
+			return errOldConfigFormat
+		}
+		return err
+	case FormatYAML:
+		err = yaml.Unmarshal(content, &data)
+		data = normalizeYAML(data)
+	case FormatTOML:
+		m := map[string]interface{}{}
+		err = toml.Unmarshal(content, &m)
+		data = m
+	case FormatJSON:
+		err = json.Unmarshal(content, &data)
+	}
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return nil
+	}
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		return errors.New(`the config must be a map`)
+	}
+	for _, key := range []string{`app`, `proxy`, `admin`, `watch`, `capture`, `page`, `maintenance`} {
+		if v, ok := m[key]; ok {
+			if _, ok := v.(map[string]interface{}); !ok {
+				return errOldConfigFormat
+			}
+		}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, conf)
+}
+
+// normalizeYAML 把yaml.v2生成的map[interface{}]interface{}转换为map[string]interface{}
+func normalizeYAML(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for key, value := range t {
+			m[fmt.Sprint(key)] = normalizeYAML(value)
+		}
+		return m
+	case []interface{}:
+		for i, value := range t {
+			t[i] = normalizeYAML(value)
+		}
+	}
+	return v
+}
+
+// encodeConfig 用指定格式输出conf。YAML保持设置的顺序，TOML按名称排序
+func encodeConfig(format string, conf *c.Config) ([]byte, error) {
+	if format == FormatConfl {
+		return confl.Marshal(conf)
+	}
+	b, err := json.MarshalIndent(conf, ``, `  `)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatJSON:
+		return append(b, '\n'), nil
+	case FormatYAML:
+		var data yaml.MapSlice
+		if err = yaml.Unmarshal(b, &data); err != nil {
+			return nil, err
+		}
+		return yaml.Marshal(data)
+	case FormatTOML:
+		var data map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.UseNumber()
+		if err = decoder.Decode(&data); err != nil {
+			return nil, err
+		}
+		buf := new(bytes.Buffer)
+		err = toml.NewEncoder(buf).Encode(data)
+		return buf.Bytes(), err
+	}
+	return nil, fmt.Errorf(`unsupported config format %q`, format)
+}
+
+// exampleConfig 生成指定格式的示例配置文件。confl格式带有说明，其它格式引用SchemaName
+func exampleConfig(format string) ([]byte, error) {
+	if format == FormatConfl {
+		return defaultConfig, nil
+	}
+	conf := c.New()
+	conf.Fixed()
+	conf.App.Args = []string{}
+	conf.App.Env = map[string]string{}
+	b, err := encodeConfig(format, conf)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatYAML:
+		b = append([]byte("# yaml-language-server: $schema=./"+SchemaName+"\n"), b...)
+	case FormatTOML:
+		b = append([]byte("#:schema ./"+SchemaName+"\n"), b...)
+	case FormatJSON:
+		b = bytes.Replace(b, []byte("{\n"), []byte("{\n  \"$schema\": \"./"+SchemaName+"\",\n"), 1)
+	}
+	return b, nil
+}
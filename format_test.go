@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	c "github.com/webx-top/tower/config"
+)
+
+func TestDetectConfigFormat(t *testing.T) {
+	for _, v := range []struct {
+		file, content, format string
+	}{
+		{`tower.yml`, "app {\n  port : \"5001\"\n}\n", FormatConfl},
+		{`tower.yml`, "app:\n  port: \"5001\"\n", FormatYAML},
+		{`tower.yaml`, "# yaml\nproxy: {port: \"8080\"}\n", FormatYAML},
+		{`tower.toml`, "[app]\nport = \"5001\"\n", FormatTOML},
+		{`tower.json`, `{"app": {"port": "5001"}}`, FormatJSON},
+		{`tower.conf`, "[app]\n", FormatConfl},
+		{`tower`, ` {"app": {}}`, FormatJSON},
+		{`tower`, "[app]\nport = \"5001\"\n", FormatTOML},
+		{`tower`, "logLevel : \"Info\"\n", FormatConfl},
+	} {
+		if format := DetectConfigFormat(v.file, []byte(v.content)); format != v.format {
+			t.Errorf("%s %q: expected %s, got %s", v.file, v.content, v.format, format)
+		}
+	}
+}
+
+func TestDecodeConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `tower-format`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		`tower.yaml`: "app:\n  port: \"6001-6010\"\n  args: [\"-a\", \"b c\"]\n  env:\n    A: \"1\"\n  stopTimeout: 3\nproxy:\n  tls:\n    enabled: true\nlogLevel: Info\n",
+		`tower.toml`: "logLevel = \"Info\"\n\n[app]\nport = \"6001-6010\"\nargs = [\"-a\", \"b c\"]\nenv = { A = \"1\" }\nstopTimeout = 3\n\n[proxy.tls]\nenabled = true\n",
+		`tower.json`: `{"$schema": "./tower.schema.json", "app": {"port": "6001-6010", "args": ["-a", "b c"], "env": {"A": "1"}, "stopTimeout": 3}, "proxy": {"tls": {"enabled": true}}, "logLevel": "Info"}`,
+	}
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		conf := c.New()
+		if err := decodeConfigFile(file, conf); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		conf.Fixed()
+		if *conf.App.Port != `6001-6010` || len(conf.App.Args) != 2 || conf.App.Args[1] != `b c` || conf.App.Env[`A`] != `1` ||
+			*conf.App.StopTimeout != 3 || !*conf.Proxy.TLS.Enabled || *conf.LogLevel != `Info` || *conf.Proxy.Port != `8080` {
+			b, _ := json.Marshal(conf)
+			t.Errorf("%s: unexpected config %s", name, b)
+		}
+	}
+
+	old := filepath.Join(dir, `old.yml`)
+	if err := ioutil.WriteFile(old, []byte("app_port: \"5001\"\nwatch: \"go\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := decodeConfigFile(old, c.New()); err != errOldConfigFormat {
+		t.Fatalf("expected old config format, got %v", err)
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `tower-init`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, format := range []string{FormatYAML, FormatTOML, FormatJSON} {
+		content, err := exampleConfig(format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		file := filepath.Join(dir, filepath.Base(configFileNames[format]))
+		if err := ioutil.WriteFile(file, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if f := DetectConfigFormat(file, content); f != format {
+			t.Fatalf("%s: detected as %s", format, f)
+		}
+		conf := c.New()
+		if err := decodeConfigFile(file, conf); err != nil {
+			t.Fatalf("%s: %v\n%s", format, err, content)
+		}
+		if *conf.App.Port != `5001-5050` || *conf.App.StopTimeout != 10 || !*conf.Proxy.HTTP2 {
+			t.Errorf("%s: unexpected example:\n%s", format, content)
+		}
+	}
+	if _, err := ParseConfigFormat(`xml`); err == nil {
+		t.Fatal(`expected an error for an unsupported format`)
+	}
+	if format, _ := ParseConfigFormat(`YML`); format != FormatYAML {
+		t.Fatalf("unexpected format %s", format)
+	}
+}
+
+func TestConfigSchema(t *testing.T) {
+	type property struct {
+		Properties map[string]*property
+	}
+	schema := &property{}
+	if err := json.Unmarshal([]byte(configSchema), schema); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range c.Keys() {
+		p := schema
+		for _, name := range strings.Split(key, `.`) {
+			if p = p.Properties[name]; p == nil {
+				break
+			}
+		}
+		if p == nil {
+			t.Errorf("%s is missing from %s", key, SchemaName)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/admpub/log"
+)
+
+const (
+	DefaultRetries           = 2
+	DefaultIdempotencyHeader = "Idempotency-Key"
+	// 需要重试的请求内容会缓存在内存中，超出此大小则不重试
+	retryMaxBodySize = 1024 * 1024
+	retryDelay       = 100 * time.Millisecond
+	// 检查旧版本程序上的长连接是否已关闭的间隔
+	streamCheckInterval = 200 * time.Millisecond
+	gatewayMaxRetryLogs = 1000
+	// 用于保留代理引擎设置的X-Forwarded-For，避免再追加本机地址
+	gatewayForwardedHeader = "X-Tower-Forwarded-For"
+)
+
+// Gateway 监听在本机随机端口上的内部代理。代理引擎把所有请求转发到这里，
+// 再由它转发给当前的后端程序，并在后端连接失败时对幂等请求进行重试
+type Gateway struct {
+	App       *App //重试次数等设置见App.Settings()
+	Transport http.RoundTripper
+	handler   http.Handler
+	server    *http.Server
+	backend   string                     //当前后端程序的端口
+	streams   map[string]int             //各后端程序上的长连接(WebSocket、SSE)数量
+	retryLogs map[string][]string        //X-Request-ID => 重试过的后端
+	failures  map[string]*BackendFailure //X-Request-ID => 失败的请求
+	mu        sync.Mutex
+}
+
+// BackendFailure 转发失败(没有响应或响应状态码为5xx)的请求，用于找到程序为该请求输出的异常信息
+type BackendFailure struct {
+	Port       string //最后一次转发的后端端口(或socket文件)
+	Conn       string //连接后端时使用的本地地址，即程序中请求的RemoteAddr。Unix socket时为空
+	StatusCode int    //没有响应时为0
+	Error      string
+}
+
+func NewGateway(app *App) *Gateway {
+	return &Gateway{
+		App: app,
+		Transport: &http.Transport{
+			DialContext:         app.DialBackend,
+			MaxIdleConnsPerHost: 100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		retryLogs: map[string][]string{},
+		failures:  map[string]*BackendFailure{},
+		streams:   map[string]int{},
+	}
+}
+
+// UseH2C 使用h2c(不加密的HTTP/2)连接后端程序。此时后端不支持WebSocket等HTTP/1.1的协议升级
+func (this *Gateway) UseH2C() {
+	transport, ok := this.Transport.(*http.Transport)
+	if !ok {
+		return
+	}
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	transport.Protocols = protocols
+}
+
+// ParseRetryStatusCodes 解析以半角逗号分隔的状态码，例如：“502,503,504”
+func ParseRetryStatusCodes(codes string) map[int]bool {
+	statusCodes := map[int]bool{}
+	for _, code := range strings.Split(codes, `,`) {
+		code = strings.TrimSpace(code)
+		if len(code) == 0 {
+			continue
+		}
+		i, err := strconv.Atoi(code)
+		if err != nil {
+			log.Error(`== Invalid retry status code: ` + code)
+			continue
+		}
+		statusCodes[i] = true
+	}
+	return statusCodes
+}
+
+// Handler 返回转发请求到后端程序的http.Handler
+func (this *Gateway) Handler() http.Handler {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.handler == nil {
+		this.handler = &httputil.ReverseProxy{
+			Director: func(r *http.Request) {
+				r.URL.Scheme = "http"
+				if xff, ok := r.Header["X-Forwarded-For"]; ok {
+					r.Header[gatewayForwardedHeader] = xff
+				}
+				r.Header["X-Forwarded-For"] = nil
+			},
+			Transport:     this,
+			FlushInterval: 100 * time.Millisecond,
+		}
+	}
+	return this.handler
+}
+
+// Listen 在本机随机端口上开始监听，返回代理引擎应该转发到的网址
+func (this *Gateway) Listen() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	this.server = &http.Server{Handler: this.Handler()}
+	go this.server.Serve(l)
+	return "http://" + l.Addr().String(), nil
+}
+
+func (this *Gateway) Close() error {
+	if this.server == nil {
+		return nil
+	}
+	return this.server.Close()
+}
+
+// SetBackend 切换到新版本程序的端口
+func (this *Gateway) SetBackend(port string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.backend = port
+}
+
+func (this *Gateway) Backend() string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.backend
+}
+
+// retryable 只有幂等请求或带有幂等头信息的请求才能重试
+func retryable(r *http.Request, settings *Settings) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return len(settings.IdempotencyHeader) > 0 && len(r.Header.Get(settings.IdempotencyHeader)) > 0
+}
+
+// backends 返回可用于重试的后端端口(或socket文件)：当前端口优先，其次是其它仍在运行的旧版本。
+// 不在这里检查端口是否可以连接，连接失败时会继续尝试下一个
+func (this *Gateway) backends(current string) []string {
+	ports := []string{current}
+	for port := range this.App.RunningCmds() {
+		if port != current {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// RoundTrip 转发请求到后端程序，必要时重试
+func (this *Gateway) RoundTrip(req *http.Request) (*http.Response, error) {
+	if xff, ok := req.Header[gatewayForwardedHeader]; ok {
+		req.Header["X-Forwarded-For"] = xff
+		delete(req.Header, gatewayForwardedHeader)
+	} else {
+		delete(req.Header, "X-Forwarded-For")
+	}
+	settings := this.App.Settings()
+	retries := 0
+	if settings.Retries > 0 && retryable(req, settings) {
+		retries = settings.Retries
+	}
+	var body []byte
+	if retries > 0 && req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(req.Body, retryMaxBodySize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > retryMaxBodySize {
+			// 请求内容太大，不缓存也不重试
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+			body = nil
+			retries = 0
+		} else {
+			req.Body.Close()
+		}
+	}
+
+	current := this.Backend()
+	var (
+		ports []string
+		tried []string
+	)
+	for attempt := 0; ; attempt++ {
+		port := current
+		if attempt > 0 {
+			if ports == nil {
+				ports = this.backends(current)
+			}
+			port = ports[attempt%len(ports)]
+		}
+		r := req.Clone(req.Context())
+		r.URL.Host = this.App.BackendHost(port)
+		if body != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+		}
+		resp, conn, err := this.try(r, settings.TryTimeout)
+		if err == nil && isStreamResponse(resp) {
+			resp.Body = &streamBody{ReadCloser: resp.Body, done: this.TrackStream(port)}
+		}
+		tried = append(tried, port)
+		// 连接建立后出错时，请求可能已经被程序处理(例如程序panic后连接被关闭)，重试会让请求执行多次
+		retry := err == nil && settings.RetryStatusCodes[resp.StatusCode] || err != nil && isDialError(err)
+		if !retry || attempt >= retries || req.Context().Err() != nil {
+			this.logRetries(req, tried)
+			this.logFailure(req, port, conn, resp, err)
+			return resp, err
+		}
+		if err == nil {
+			log.Warnf("== Retry %s %s: backend %s responded %d", req.Method, req.URL.Path, port, resp.StatusCode)
+			resp.Body.Close()
+		} else {
+			log.Warnf("== Retry %s %s: backend %s: %v", req.Method, req.URL.Path, port, err)
+		}
+		time.Sleep(retryDelay)
+	}
+}
+
+// isDialError 是否为连接后端失败(例如旧版本程序已退出)，此时请求还没有发送给程序
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == `dial`
+}
+
+// try 发送一次请求。timeout只限制等待响应头的时间，不影响后续的响应内容(例如SSE)
+// 返回的conn为连接后端时使用的本地地址
+func (this *Gateway) try(r *http.Request, timeout time.Duration) (resp *http.Response, conn string, err error) {
+	r = traceBackendConn(r, &conn)
+	if timeout <= 0 {
+		resp, err = this.Transport.RoundTrip(r)
+		return
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	timer := time.AfterFunc(timeout, cancel)
+	resp, err = this.Transport.RoundTrip(r.WithContext(ctx))
+	timer.Stop()
+	if err != nil {
+		cancel()
+		return nil, conn, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return
+}
+
+// traceBackendConn 把连接后端时使用的本地地址保存到conn，程序输出的“http: panic serving”中的地址与之相同。
+// 只记录TCP连接，Unix socket连接没有可以区分的地址
+func traceBackendConn(r *http.Request, conn *string) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if addr, ok := info.Conn.LocalAddr().(*net.TCPAddr); ok {
+				*conn = addr.String()
+			}
+		},
+	}
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (this *cancelBody) Close() error {
+	err := this.ReadCloser.Close()
+	this.cancel()
+	return err
+}
+
+// Write 使101 Switching Protocols(WebSocket)的响应内容可写
+func (this *cancelBody) Write(p []byte) (int, error) {
+	if w, ok := this.ReadCloser.(io.Writer); ok {
+		return w.Write(p)
+	}
+	return 0, io.ErrClosedPipe
+}
+
+func (this *Gateway) logRetries(req *http.Request, tried []string) {
+	if len(tried) < 2 {
+		return
+	}
+	id := req.Header.Get("X-Request-ID")
+	if len(id) == 0 {
+		log.Infof("== Request %s %s retried %d times (backends: %s)", req.Method, req.URL.Path, len(tried)-1, strings.Join(tried, ` => `))
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if len(this.retryLogs) >= gatewayMaxRetryLogs {
+		this.retryLogs = map[string][]string{}
+	}
+	this.retryLogs[id] = tried
+}
+
+func (this *Gateway) logFailure(req *http.Request, port string, conn string, resp *http.Response, err error) {
+	failure := &BackendFailure{Port: port, Conn: conn}
+	if err != nil {
+		failure.Error = err.Error()
+	} else if resp.StatusCode >= 500 {
+		failure.StatusCode = resp.StatusCode
+	} else {
+		return
+	}
+	id := req.Header.Get("X-Request-ID")
+	if len(id) == 0 {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if len(this.failures) >= gatewayMaxRetryLogs {
+		this.failures = map[string]*BackendFailure{}
+	}
+	this.failures[id] = failure
+}
+
+// TakeFailure 取出转发失败的记录，请求成功时返回nil
+func (this *Gateway) TakeFailure(requestID string) *BackendFailure {
+	if len(requestID) == 0 {
+		return nil
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	failure := this.failures[requestID]
+	delete(this.failures, requestID)
+	return failure
+}
+
+// TakeRetries 取出请求的重试记录，供EndRequest记录日志
+func (this *Gateway) TakeRetries(requestID string) []string {
+	if len(requestID) == 0 {
+		return nil
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	tried := this.retryLogs[requestID]
+	delete(this.retryLogs, requestID)
+	return tried
+}
+
+// TrackStream 记录后端程序上新建立的长连接(WebSocket、SSE、gRPC调用、TCP连接)，连接关闭时调用返回的函数
+func (this *Gateway) TrackStream(port string) (done func()) {
+	this.mu.Lock()
+	this.streams[port]++
+	this.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			this.mu.Lock()
+			this.streams[port]--
+			if this.streams[port] <= 0 {
+				delete(this.streams, port)
+			}
+			this.mu.Unlock()
+		})
+	}
+}
+
+// Streams 返回除current外其它后端程序上的长连接数量
+func (this *Gateway) Streams(current string) (n int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for port, count := range this.streams {
+		if port != current {
+			n += count
+		}
+	}
+	return
+}
+
+// WaitStreams 等待旧版本程序上的长连接全部关闭，最多等待timeout
+func (this *Gateway) WaitStreams(current string, timeout time.Duration) {
+	n := this.Streams(current)
+	if n == 0 || timeout <= 0 {
+		return
+	}
+	log.Infof("== Waiting for %d long-lived connection(s) on the old version to close", n)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(streamCheckInterval)
+		if n = this.Streams(current); n == 0 {
+			return
+		}
+	}
+	log.Warnf("== Grace period ended, closing %d long-lived connection(s) on the old version", n)
+}
+
+// isStreamResponse 是否为WebSocket、SSE或gRPC等长连接的响应
+func isStreamResponse(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return true
+	}
+	contentType := resp.Header.Get(`Content-Type`)
+	return strings.HasPrefix(contentType, `text/event-stream`) || strings.HasPrefix(contentType, `application/grpc`)
+}
+
+// CloseIdleConnections 关闭到旧版本程序的空闲连接
+func (this *Gateway) CloseIdleConnections() {
+	if t, ok := this.Transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// streamBody 长连接关闭时更新连接数量
+type streamBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (this *streamBody) Close() error {
+	err := this.ReadCloser.Close()
+	this.done()
+	return err
+}
+
+func (this *streamBody) Write(p []byte) (int, error) {
+	if w, ok := this.ReadCloser.(io.Writer); ok {
+		return w.Write(p)
+	}
+	return 0, io.ErrClosedPipe
+}
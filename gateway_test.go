@@ -0,0 +1,197 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGatewayRetry(t *testing.T) {
+	failures := 1
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(503)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(r.Method + ` ` + string(body)))
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+
+	g := NewGateway(&App{Cmds: map[string]*exec.Cmd{}})
+	settings := NewSettings()
+	settings.RetryStatusCodes = ParseRetryStatusCodes(`503`)
+	g.App.UseSettings(settings)
+	addr, err := g.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.SetBackend(u.Port())
+
+	req, _ := http.NewRequest(`POST`, addr+`/`, strings.NewReader(`data`))
+	req.Header.Set(`Idempotency-Key`, `1`)
+	req.Header.Set(`X-Request-ID`, `r1`)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != `POST data` {
+		t.Fatalf("unexpected response: %d %q", resp.StatusCode, body)
+	}
+	if tried := g.TakeRetries(`r1`); len(tried) != 2 {
+		t.Fatalf("expected one retry, got %v", tried)
+	}
+
+	// 非幂等请求不重试
+	failures = 1
+	resp, err = http.Post(addr+`/`, `text/plain`, strings.NewReader(`data`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 503 {
+		t.Fatalf("POST should not be retried, got %d", resp.StatusCode)
+	}
+}
+
+func TestGatewayRetryDialError(t *testing.T) {
+	var (
+		requests   int32
+		remoteAddr atomic.Value
+	)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path == `/panic` {
+			remoteAddr.Store(r.RemoteAddr)
+			// 与net/http在handler panic后的处理相同：不返回响应，直接关闭连接
+			panic(http.ErrAbortHandler)
+		}
+		w.Write([]byte(`old`))
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	v, _ := url.Parse(closed.URL)
+
+	app := &App{Cmds: map[string]*exec.Cmd{}}
+	cmd := exec.Command(`old`)
+	trackCmd(cmd)
+	defer cmdExited(cmd)
+	app.SetCmd(u.Port(), cmd)
+	g := NewGateway(app)
+	addr, err := g.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	// 当前版本无法连接时，转发到仍在运行的旧版本
+	g.SetBackend(v.Port())
+	resp, err := http.Get(addr + `/`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != `old` {
+		t.Fatalf("unexpected response: %d %q", resp.StatusCode, body)
+	}
+
+	// 程序收到请求后断开连接时不重试。
+	// 先关闭空闲连接：net/http在复用的连接上出错时会自行重发一次幂等请求
+	atomic.StoreInt32(&requests, 0)
+	g.SetBackend(u.Port())
+	g.CloseIdleConnections()
+	req, _ := http.NewRequest(`GET`, addr+`/panic`, nil)
+	req.Header.Set(`X-Request-ID`, `r2`)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := atomic.LoadInt32(&requests); resp.StatusCode != http.StatusBadGateway || n != 1 {
+		t.Fatalf("request should not be retried: %d, %d requests", resp.StatusCode, n)
+	}
+	// 记录的连接地址与程序输出的“http: panic serving <地址>”相同
+	failure := g.TakeFailure(`r2`)
+	if failure == nil || failure.Port != u.Port() || failure.Conn != remoteAddr.Load() {
+		t.Fatalf("unexpected failure: %+v, backend saw %v", failure, remoteAddr.Load())
+	}
+}
+
+func TestGatewayH2C(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+
+	g := NewGateway(&App{Cmds: map[string]*exec.Cmd{}})
+	g.UseH2C()
+	addr, err := g.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.SetBackend(u.Port())
+	resp, err := http.Get(addr + `/`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != `HTTP/2.0` {
+		t.Fatalf("backend should be reached over h2c, got %q", body)
+	}
+}
+
+func TestGatewayTrackStreams(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(`Content-Type`, `text/event-stream`)
+		w.Write([]byte("data: hello\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+
+	g := NewGateway(&App{Cmds: map[string]*exec.Cmd{}})
+	addr, err := g.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.SetBackend(u.Port())
+	resp, err := http.Get(addr + `/events`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	resp.Body.Read(buf)
+	if n := g.Streams(`new`); n != 1 {
+		t.Fatalf("expected 1 stream on the old backend, got %d", n)
+	}
+	if n := g.Streams(u.Port()); n != 0 {
+		t.Fatalf("streams on the current backend should be excluded, got %d", n)
+	}
+	resp.Body.Close()
+	g.WaitStreams(`new`, 5*time.Second)
+	if n := g.Streams(`new`); n != 0 {
+		t.Fatalf("stream should be released after close, got %d", n)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/admpub/log"
+)
+
+const (
+	AppTypeHTTP = "http"
+	// AppTypeGRPC gRPC服务。代理通过HTTP/2(h2c)转发，并以grpc.health.v1作为就绪检查
+	AppTypeGRPC = "grpc"
+
+	FeatureGRPC = "gRPC"
+
+	// gRPC状态码
+	grpcStatusOK            = 0
+	grpcStatusUnimplemented = 12
+	grpcStatusUnavailable   = 14
+
+	// grpc.health.v1.HealthCheckResponse.ServingStatus
+	grpcServing = 1
+
+	grpcHealthCheckPath     = "/grpc.health.v1.Health/Check"
+	grpcHealthCheckInterval = 500 * time.Millisecond
+	grpcHealthCheckTimeout  = 2 * time.Second
+)
+
+var errGRPCNotServing = errors.New("== gRPC health check: not serving")
+
+// IsGRPC 是否为gRPC服务
+func (this *App) IsGRPC() bool {
+	return strings.ToLower(this.Type) == AppTypeGRPC
+}
+
+// waitGRPCServing 等待端口(或socket文件)上的gRPC服务的健康检查返回SERVING，最多等待timeout秒
+func waitGRPCServing(app *App, port string, service string, timeout int, alive func() bool) error {
+	client := newGRPCHealthClient(app.DialBackend)
+	defer client.CloseIdleConnections()
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+	var err error
+	for {
+		err = grpcHealthCheck(client, app.BackendHost(port), service)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		if alive != nil && !alive() {
+			return nil
+		}
+		time.Sleep(grpcHealthCheckInterval)
+	}
+}
+
+// newGRPCHealthClient 使用h2c的客户端，dial为nil时直接连接TCP地址
+func newGRPCHealthClient(dial func(ctx context.Context, network string, addr string) (net.Conn, error)) *http.Client {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: protocols, DialContext: dial}}
+}
+
+// grpcHealthCheck 调用grpc.health.v1.Health/Check。服务未实现健康检查时认为已就绪
+func grpcHealthCheck(client *http.Client, address string, service string) error {
+	// HealthCheckRequest{service = 1}
+	msg := []byte{}
+	if len(service) > 0 {
+		msg = append(msg, 0x0a)
+		msg = binary.AppendUvarint(msg, uint64(len(service)))
+		msg = append(msg, service...)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), grpcHealthCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, `http://`+address+grpcHealthCheckPath, bytes.NewReader(grpcFrame(msg)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(`Content-Type`, `application/grpc`)
+	req.Header.Set(`TE`, `trailers`)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	status := resp.Trailer.Get(`Grpc-Status`)
+	if len(status) == 0 {
+		// Trailers-Only响应
+		status = resp.Header.Get(`Grpc-Status`)
+	}
+	code, _ := strconv.Atoi(status)
+	switch code {
+	case grpcStatusOK:
+	case grpcStatusUnimplemented:
+		log.Warn(`== gRPC health service is not implemented, skip the readiness check`)
+		return nil
+	default:
+		return errors.New(`== gRPC health check: status ` + status + ` ` + resp.Trailer.Get(`Grpc-Message`))
+	}
+	if grpcServingStatus(body) != grpcServing {
+		return errGRPCNotServing
+	}
+	return nil
+}
+
+// grpcFrame 给消息加上gRPC的长度前缀(不压缩)
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// grpcServingStatus 解析HealthCheckResponse{status = 1}
+func grpcServingStatus(body []byte) uint64 {
+	if len(body) < 5 {
+		return 0
+	}
+	msg := body[5:]
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0
+		}
+		msg = msg[n:]
+		if key>>3 == 1 && key&7 == 0 {
+			v, _ := binary.Uvarint(msg)
+			return v
+		}
+		// 跳过其它字段
+		switch key & 7 {
+		case 0:
+			_, n = binary.Uvarint(msg)
+		case 2:
+			l, m := binary.Uvarint(msg)
+			n = m + int(l)
+		default:
+			return 0
+		}
+		if n <= 0 || n > len(msg) {
+			return 0
+		}
+		msg = msg[n:]
+	}
+	return 0
+}
+
+// isGRPCRequest 是否为gRPC请求
+func isGRPCRequest(ctx Context) bool {
+	return strings.HasPrefix(requestHeader(ctx, `Content-Type`), `application/grpc`)
+}
+
+// renderGRPCError 以gRPC的Trailers-Only响应返回错误，客户端会得到UNAVAILABLE
+func renderGRPCError(ctx Context, message string) {
+	ctx.SetHeader(`Content-Type`, `application/grpc`)
+	ctx.SetHeader(`Grpc-Status`, strconv.Itoa(grpcStatusUnavailable))
+	ctx.SetHeader(`Grpc-Message`, url.PathEscape(message))
+	ctx.SetStatusCode(http.StatusOK)
+	ctx.SetBody(nil)
+}
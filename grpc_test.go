@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestGRPCHealthCheck(t *testing.T) {
+	status := byte(grpcServing)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != grpcHealthCheckPath || r.ProtoMajor != 2 {
+			w.Header().Set(`Grpc-Status`, `12`)
+			return
+		}
+		w.Header().Set(`Content-Type`, `application/grpc`)
+		w.Header().Set(`Trailer`, `Grpc-Status`)
+		w.Write(grpcFrame([]byte{0x08, status}))
+		w.Header().Set(`Grpc-Status`, `0`)
+	}))
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+	client := newGRPCHealthClient(nil)
+
+	if err := grpcHealthCheck(client, u.Host, ``); err != nil {
+		t.Fatal(err)
+	}
+	status = 2 // NOT_SERVING
+	if err := grpcHealthCheck(client, u.Host, `app.Service`); err != errGRPCNotServing {
+		t.Fatalf("expected not serving, got %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"go/scanner"
+	"go/token"
+	"html"
+	"html/template"
+	"strings"
+)
+
+var goBuiltins = map[string]bool{
+	"append": true, "cap": true, "clear": true, "close": true, "complex": true,
+	"copy": true, "delete": true, "imag": true, "len": true, "make": true,
+	"max": true, "min": true, "new": true, "panic": true, "print": true,
+	"println": true, "real": true, "recover": true,
+	"any": true, "bool": true, "byte": true, "comparable": true, "complex64": true,
+	"complex128": true, "error": true, "float32": true, "float64": true,
+	"int": true, "int8": true, "int16": true, "int32": true, "int64": true,
+	"rune": true, "string": true, "uint": true, "uint8": true, "uint16": true,
+	"uint32": true, "uint64": true, "uintptr": true,
+	"true": true, "false": true, "iota": true, "nil": true,
+}
+
+// highlightGo 使用go/scanner为Go源码着色，返回每一行的HTML。
+// 跨行的注释和字符串会在每一行分别闭合<span>标签。
+func highlightGo(src []byte) []template.HTML {
+	h := &highlighter{}
+	fset := token.NewFileSet()
+	file := fset.AddFile("", fset.Base(), len(src))
+	var s scanner.Scanner
+	s.Init(file, src, func(token.Position, string) {}, scanner.ScanComments)
+	last := 0
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		if tok == token.SEMICOLON && lit == "\n" {
+			continue // 自动插入的分号
+		}
+		offset := file.Offset(pos)
+		if offset < last || offset >= len(src) {
+			continue
+		}
+		end := tokenEnd(src, offset, tok, lit)
+		h.write(src[last:offset], "")
+		h.write(src[offset:end], tokenClass(tok, lit))
+		last = end
+	}
+	h.write(src[last:], "")
+	return h.finish()
+}
+
+// tokenEnd 计算记号在源码中的结束位置。注释和原始字符串中的\r会被scanner去掉，因此不能直接使用lit的长度
+func tokenEnd(src []byte, offset int, tok token.Token, lit string) (end int) {
+	switch {
+	case tok == token.COMMENT && strings.HasPrefix(lit, "//"):
+		end = bytes.IndexByte(src[offset:], '\n')
+	case tok == token.COMMENT:
+		if end = bytes.Index(src[offset+2:], []byte("*/")); end > -1 {
+			end += 4
+		}
+	case tok == token.STRING && strings.HasPrefix(lit, "`"):
+		if end = bytes.IndexByte(src[offset+1:], '`'); end > -1 {
+			end += 2
+		}
+	case len(lit) > 0:
+		end = len(lit)
+	default:
+		end = len(tok.String())
+	}
+	if end < 0 || offset+end > len(src) {
+		return len(src)
+	}
+	return offset + end
+}
+
+func tokenClass(tok token.Token, lit string) string {
+	switch {
+	case tok == token.COMMENT:
+		return "com"
+	case tok == token.STRING || tok == token.CHAR:
+		return "str"
+	case tok == token.INT || tok == token.FLOAT || tok == token.IMAG:
+		return "num"
+	case tok.IsKeyword():
+		return "kw"
+	case tok == token.IDENT && goBuiltins[lit]:
+		return "bi"
+	}
+	return ""
+}
+
+type highlighter struct {
+	lines []template.HTML
+	line  bytes.Buffer
+}
+
+func (this *highlighter) write(text []byte, class string) {
+	for i, part := range strings.Split(string(text), "\n") {
+		if i > 0 {
+			this.lines = append(this.lines, template.HTML(this.line.String()))
+			this.line.Reset()
+		}
+		part = strings.TrimSuffix(part, "\r")
+		if len(part) == 0 {
+			continue
+		}
+		if len(class) > 0 {
+			this.line.WriteString(`<span class="` + class + `">` + html.EscapeString(part) + `</span>`)
+		} else {
+			this.line.WriteString(html.EscapeString(part))
+		}
+	}
+}
+
+func (this *highlighter) finish() []template.HTML {
+	return append(this.lines, template.HTML(this.line.String()))
+}
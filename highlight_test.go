@@ -0,0 +1,44 @@
+package main
+
+import (
+	"html/template"
+	"testing"
+)
+
+func TestHighlightGo(t *testing.T) {
+	src := "package main\r\n\r\n/* a\r\nb */\r\nfunc main() {\r\n\ts := `x\r\ny` // <c>\r\n}\r\n"
+	lines := highlightGo([]byte(src))
+	expected := []template.HTML{
+		`<span class="kw">package</span> main`,
+		``,
+		`<span class="com">/* a</span>`,
+		`<span class="com">b */</span>`,
+		`<span class="kw">func</span> main() {`,
+		"\ts := <span class=\"str\">`x</span>",
+		"<span class=\"str\">y`</span> <span class=\"com\">// &lt;c&gt;</span>",
+		`}`,
+		``,
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %d: %q", len(expected), len(lines), lines)
+	}
+	for i, line := range lines {
+		if line != expected[i] {
+			t.Errorf("line %d: expected %q, got %q", i+1, expected[i], line)
+		}
+	}
+}
+
+func TestExtractAppSnippet(t *testing.T) {
+	lines := highlightGo([]byte("package main\n\nfunc main() {\n}\n"))
+	snippet, errMessage := extractAppSnippet(lines, 1)
+	if len(errMessage) > 0 || len(snippet) == 0 || snippet[0].Number != 1 || !snippet[0].Current {
+		t.Errorf("unexpected snippet: %+v %s", snippet, errMessage)
+	}
+	if _, errMessage = extractAppSnippet(lines, 100); len(errMessage) == 0 {
+		t.Error("expected out of range error")
+	}
+	if _, errMessage = extractAppSnippet(nil, 1); len(errMessage) == 0 {
+		t.Error("expected missing file error")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/admpub/log"
+)
+
+// 运行参数、环境变量和配置文件模板中可以使用的占位符
+const (
+	portPlaceholder   = `{{port}}`   //端口(使用Unix socket时为socket文件路径)
+	addrPlaceholder   = `{{addr}}`   //监听地址，例如：127.0.0.1:5001
+	configPlaceholder = `{{config}}` //由模板生成的配置文件路径
+)
+
+// injectsPort 是否能把端口告诉程序(端口参数、环境变量、参数中的占位符或配置文件模板)
+func (this *App) injectsPort() bool {
+	settings := this.Settings()
+	if len(this.PortParamName) > 0 || len(settings.PortEnv) > 0 || len(this.ConfigTemplate) > 0 {
+		return true
+	}
+	for _, param := range settings.RunParams {
+		if strings.Contains(param, portPlaceholder) || strings.Contains(param, addrPlaceholder) {
+			return true
+		}
+	}
+	return false
+}
+
+// instanceName 程序实例的名称，用于生成配置文件名
+func (this *App) instanceName(port string) string {
+	if this.IsSocket(port) {
+		return strings.TrimSuffix(filepath.Base(port), socketExt)
+	}
+	return BinPrefix + port
+}
+
+// ConfigFile 返回port对应的程序实例使用的配置文件，与模板位于同一目录。
+// 例如模板“config.yaml.tpl”对应“tower-app-5001.yaml”。没有设置模板时返回空字符串
+func (this *App) ConfigFile(port string) string {
+	if len(this.ConfigTemplate) == 0 {
+		return ``
+	}
+	name := filepath.Base(this.ConfigTemplate)
+	for _, ext := range []string{`.tpl`, `.tmpl`, `.template`} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return filepath.Join(filepath.Dir(this.ConfigTemplate), this.instanceName(port)+filepath.Ext(name))
+}
+
+func (this *App) portReplacer(port string) *strings.Replacer {
+	_, addr := this.BackendAddress(port)
+	return strings.NewReplacer(
+		portPlaceholder, port,
+		addrPlaceholder, addr,
+		configPlaceholder, this.ConfigFile(port),
+	)
+}
+
+// renderConfig 用ConfigTemplate生成port对应实例的配置文件
+func (this *App) renderConfig(port string) error {
+	if len(this.ConfigTemplate) == 0 {
+		return nil
+	}
+	b, err := ioutil.ReadFile(this.ConfigTemplate)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(this.ConfigFile(port), []byte(this.portReplacer(port).Replace(string(b))), 0600)
+}
+
+// runParams 返回运行port对应实例的参数。withPortParam为true时在最前面加上端口参数
+func (this *App) runParams(port string, withPortParam bool) []string {
+	params := []string{}
+	if withPortParam && len(this.PortParamName) > 0 {
+		params = append(params, this.PortParamName, port)
+	}
+	r := this.portReplacer(port)
+	for _, param := range this.Settings().RunParams {
+		params = append(params, r.Replace(param))
+	}
+	return params
+}
+
+// runEnv 在env中加上程序的环境变量(Env)和PortEnv指定的环境变量，两者的值中都可以使用占位符。
+// PortEnv以半角逗号分隔，每一项为变量名(值为端口)或“变量名=值”，
+// 例如：“PORT,ADDR=127.0.0.1:{{port}}”
+func (this *App) runEnv(env []string, port string) []string {
+	settings := this.Settings()
+	if len(settings.PortEnv) == 0 && len(settings.Env) == 0 {
+		return env
+	}
+	if env == nil {
+		env = os.Environ()
+	}
+	r := this.portReplacer(port)
+	for _, item := range settings.Env {
+		env = append(env, r.Replace(item))
+	}
+	for _, item := range strings.Split(settings.PortEnv, `,`) {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		name, value := item, portPlaceholder
+		if pos := strings.Index(item, `=`); pos > 0 {
+			name, value = item[:pos], item[pos+1:]
+		}
+		env = append(env, name+`=`+r.Replace(value))
+	}
+	return env
+}
+
+// cleanInstance 删除port对应实例的socket文件和配置文件
+func (this *App) cleanInstance(port string) {
+	this.removeSocket(port)
+	if file := this.ConfigFile(port); len(file) > 0 {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.Error(err)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInjectPort(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `tower-inject`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tpl := filepath.Join(dir, `config.yaml.tpl`)
+	if err := ioutil.WriteFile(tpl, []byte(`listen: {{addr}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	app := &App{ConfigTemplate: tpl}
+	app.UseSettings(&Settings{
+		RunParams: []string{`--addr={{addr}}`, `-c`, `{{config}}`},
+		PortEnv:   `PORT, ADDR=:{{port}}`,
+	})
+	if !app.injectsPort() {
+		t.Fatal("port should be injected")
+	}
+	config := filepath.Join(dir, `tower-app-5001.yaml`)
+	params := app.runParams(`5001`, false)
+	if expected := []string{`--addr=127.0.0.1:5001`, `-c`, config}; !reflect.DeepEqual(params, expected) {
+		t.Fatalf("unexpected params: %v", params)
+	}
+	env := app.runEnv([]string{}, `5001`)
+	if expected := []string{`PORT=5001`, `ADDR=:5001`}; !reflect.DeepEqual(env, expected) {
+		t.Fatalf("unexpected env: %v", env)
+	}
+	if err := app.renderConfig(`5001`); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(config); string(b) != `listen: 127.0.0.1:5001` {
+		t.Fatalf("unexpected config: %q", b)
+	}
+	app.cleanInstance(`5001`)
+	if _, err := os.Stat(config); !os.IsNotExist(err) {
+		t.Fatal("config file should be removed")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -31,41 +32,84 @@ var (
 	build = "1"
 )
 
+// flagSettings 命令行参数对应的设置。只有在命令行中明确指定的参数才会覆盖其它来源的设置
+var flagSettings = map[string]string{
+	"f":                `app.exec`,
+	"m":                `app.main`,
+	"p":                `app.port`,
+	"r":                `proxy.port`,
+	"e":                `proxy.engine`,
+	"o":                `app.buildDir`,
+	"n":                `app.portParamName`,
+	"s":                `app.params`,
+	"v":                `verbose`,
+	"w":                `admin.password`,
+	"i":                `admin.ips`,
+	"a":                `autoClear`,
+	"logLevel":         `logLevel`,
+	"offline":          `offline`,
+	"logRequest":       `logRequest`,
+	"editor":           `editor`,
+	"fileExtention":    `watch.fileExtension`,
+	"watchOtherDir":    `watch.otherDir`,
+	"watchIgnoredPath": `watch.ignoredPath`,
+}
+
+var (
+	configFileFlag string
+	configFileSet  bool         //是否用-c指定了配置文件
+	setFlags       []*flag.Flag //命令行中明确指定的参数
+)
+
 func main() {
-	c.Conf.App.ExecFile = flag.String("f", "tower-app-*.exe", "path to your app's main file.")
-	c.Conf.App.MainFile = flag.String("m", "", "path to your app's main file.")
-	c.Conf.App.Port = flag.String("p", "5001-5050", "port range of your app.")
-	c.Conf.Proxy.Port = flag.String("r", "8080", "proxy port of your app.")
-	c.Conf.Proxy.Engine = flag.String("e", "standard", "fast/standard")
-	c.Conf.App.BuildDir = flag.String("o", "", "save the executable file the folder.")
-	c.Conf.App.PortParamName = flag.String("n", "", "app's port param name.")
-	c.Conf.App.RunParams = flag.String("s", "", "app's run params.")
-	c.Conf.Verbose = flag.Bool("v", false, "show more stuff.")
-	c.Conf.ConfigFile = flag.String("c", ConfigName, "yaml configuration file location.")
-	c.Conf.Admin.Password = flag.String("w", "", "admin password.")
-	c.Conf.Admin.IPs = flag.String("i", "127.0.0.1,::1", "admin allow IP.")
-	c.Conf.AutoClear = flag.Bool("a", true, "automatically deletes previously compiled files when you startup Tower in the compile mode")
-	c.Conf.LogLevel = flag.String("logLevel", "Debug", "logger level(Debug/Info/Warn/Error/Fatal)")
-	c.Conf.Offline = flag.Bool("offline", true, "offline mode")
-	c.Conf.LogRequest = flag.Bool("logRequest", true, "")
-	c.Conf.Watch.FileExtension = flag.String("fileExtention", "go", "")
-	c.Conf.Watch.OtherDir = flag.String("watchOtherDir", "", "")
-	c.Conf.Watch.IgnoredPath = flag.String("watchIgnoredPath", "/\\.git", "")
+	flag.String("f", "tower-app-*.exe", "path to your app's main file.")
+	flag.String("m", "", "path to your app's main file.")
+	flag.String("p", "5001-5050", "port range of your app.")
+	flag.String("r", "8080", "proxy port of your app.")
+	flag.String("e", "standard", "fast/standard")
+	flag.String("o", "", "save the executable file the folder.")
+	flag.String("n", "", "app's port param name.")
+	flag.String("s", "", "app's run params.")
+	flag.Bool("v", false, "show more stuff.")
+	flag.StringVar(&configFileFlag, "c", ConfigName, "yaml configuration file location.")
+	flag.String("w", "", "admin password.")
+	flag.String("i", "127.0.0.1,::1", "admin allow IP.")
+	flag.Bool("a", true, "automatically deletes previously compiled files when you startup Tower in the compile mode")
+	flag.String("logLevel", "Debug", "logger level(Debug/Info/Warn/Error/Fatal)")
+	flag.Bool("offline", true, "offline mode")
+	flag.Bool("logRequest", true, "")
+	flag.String("editor", "", "editor for links on the error page(vscode/idea/goland/subl or a URL template containing {path} and {line})")
+	flag.String("fileExtention", "go", "")
+	flag.String("watchOtherDir", "", "")
+	flag.String("watchIgnoredPath", "/\\.git", "")
 	prod := flag.String("prod", "", "Production mode")
 
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		if _, ok := flagSettings[f.Name]; ok {
+			setFlags = append(setFlags, f)
+		}
+		if f.Name == "c" {
+			configFileSet = true
+		}
+	})
 
-	args := flag.Args()
-	if len(args) == 1 && args[0] == "init" {
-		generateExampleConfig()
-		return
-	}
-	if !fileExist(*c.Conf.ConfigFile) {
-		generateExampleConfig()
-	}
 	if len(*prod) > 0 && atob(*prod) {
 		build = "0"
 	}
+	args := flag.Args()
+	if len(args) > 0 {
+		switch args[0] {
+		case "init":
+			initFlags := flag.NewFlagSet("init", flag.ExitOnError)
+			format := initFlags.String("format", FormatConfl, "config file format("+strings.Join(configFormats, "/")+")")
+			initFlags.Parse(args[1:])
+			generateExampleConfig(*format)
+			return
+		case "check":
+			os.Exit(checkConfig())
+		}
+	}
 	startTower()
 }
 
@@ -84,23 +128,37 @@ func saveFile(filePath string, b []byte) (int, error) {
 	return fw.Write(b)
 }
 
-func generateExampleConfig() {
-	configContent := defaultConfig
-	var err error
-	/*
-		c.Conf.Fixed()
-		configContent, err = confl.Marshal(c.Conf)
-		if err != nil {
-			log.Fatal(err)
-			return
-		}
-	*/
-	_, err = saveFile(ConfigName, configContent)
+// generateExampleConfig 生成指定格式的示例配置文件，YAML、TOML和JSON格式同时生成JSON Schema
+func generateExampleConfig(format string) {
+	format, err := ParseConfigFormat(format)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	configContent, err := exampleConfig(format)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	configFile := configFileNames[format]
+	if configFileSet {
+		configFile = configFileFlag
+	}
+	_, err = saveFile(configFile, configContent)
 	if err != nil {
 		log.Error(err)
 		return
 	}
-	log.Info("== Generated config file " + ConfigName)
+	log.Info("== Generated config file " + configFile)
+	if format == FormatConfl {
+		return
+	}
+	schemaFile := filepath.Join(filepath.Dir(configFile), SchemaName)
+	if _, err = saveFile(schemaFile, []byte(configSchema)); err != nil {
+		log.Error(err)
+		return
+	}
+	log.Info("== Generated JSON Schema " + schemaFile)
 }
 
 func atob(a string) bool {
@@ -177,58 +235,146 @@ func checkBinFile(appMainFile string, suffix string, _suffix *string, appBuildDi
 	return nil
 }
 
+// loadLayeredConfig 依次合并默认值、配置文件、TOWER_*环境变量和命令行中明确指定的参数，后者优先。
+// 配置文件不存在时忽略；读取出错时仍然返回合并了其它来源的配置
+func loadLayeredConfig(file string) (*c.Config, error) {
+	var err error
+	conf := c.New()
+	if fileExist(file) {
+		fileConf := c.New()
+		err = decodeConfigFile(file, fileConf)
+		if ignored := fileConf.Watch.IgnoredPath; ignored != nil && strings.Contains(*ignored, `\\`) {
+			*ignored = strings.Replace(*ignored, `\\`, `\`, -1)
+		}
+		conf.Merge(fileConf, c.SourceFile)
+	}
+	if e := conf.LoadEnv(os.Environ()); e != nil && err == nil {
+		err = e
+	}
+	for _, f := range setFlags {
+		if e := conf.Set(flagSettings[f.Name], f.Value.String(), c.SourceFlag+` -`+f.Name); e != nil && err == nil {
+			err = e
+		}
+	}
+	conf.Fixed()
+	conf.ConfigFile = &file
+	return conf, err
+}
+
+// loadConfig 读取配置(见loadLayeredConfig)，并转换旧格式的配置文件
+func loadConfig() (configFile string, err error) {
+	configFile = findConfigFile()
+	conf, err := loadLayeredConfig(configFile)
+	if err == errOldConfigFormat {
+		if err = upgradeConfigFile(configFile); err == nil {
+			conf, err = loadLayeredConfig(configFile)
+		}
+	}
+	c.Conf = conf
+	return
+}
+
+// findConfigFile 返回-c指定的配置文件。没有指定时依次查找tower.yml、tower.toml和tower.json，都不存在时返回tower.yml
+func findConfigFile() string {
+	if configFileSet && len(configFileFlag) > 0 {
+		return configFileFlag
+	}
+	for _, format := range configFormats {
+		if file := configFileNames[format]; fileExist(file) {
+			return file
+		}
+	}
+	return ConfigName
+}
+
+// upgradeConfigFile 把旧格式的配置文件转换为新格式，原文件加上时间后缀保留
+func upgradeConfigFile(configFile string) error {
+	c.Conf = c.New()
+	err := convertOldConfigFormat(configFile)
+	if err != nil {
+		return err
+	}
+	os.Rename(configFile, configFile+`.`+time.Now().Format(`20060102150405`))
+	c.Conf.Fixed()
+	configContent, err := confl.Marshal(c.Conf)
+	if err != nil {
+		return err
+	}
+	if _, err = saveFile(configFile, configContent); err != nil {
+		return err
+	}
+	log.Info("== Upgrade config file " + configFile)
+	return nil
+}
+
+// printSources 以注释的形式输出不是默认值的设置的来源(输出到stderr，以免JSON格式的配置无效)
+func printSources(conf *c.Config) {
+	for _, key := range c.Keys() {
+		if source := conf.Source(key); source != c.SourceDefault {
+			fmt.Fprintf(os.Stderr, "# %s: %s\n", key, source)
+		}
+	}
+}
+
+// checkConfig 检查配置，输出合并了各来源之后的配置及各设置的来源。有错误时返回1
+func checkConfig() int {
+	configFile, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if !fileExist(configFile) {
+		fmt.Fprintln(os.Stderr, configFile+`: file does not exist, using defaults`)
+	}
+	content, _ := ioutil.ReadFile(configFile)
+	content, err = encodeConfig(DetectConfigFormat(configFile, content), c.Conf)
+	if err == nil {
+		fmt.Println(string(content))
+	}
+	printSources(c.Conf)
+	errs := NewConfigValidator(configFile, atob(build)).Validate(c.Conf)
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, configFile+`: OK`)
+	return 0
+}
+
 func startTower() {
 	var (
 		allowBuild = atob(build)
 		suffix     = ".exe"
 		_suffix    = ""
 	)
-	if len(*c.Conf.ConfigFile) == 0 {
-		*c.Conf.ConfigFile = ConfigName
-	}
-	configFile := *c.Conf.ConfigFile
-	_, err := confl.DecodeFile(configFile, c.Conf)
+	configFile, err := loadConfig()
 	if err != nil {
-		if strings.HasSuffix(err.Error(), `. Expected map but found 'string'.`) {
-			err = convertOldConfigFormat(configFile)
-			if err != nil {
-				log.Error(err.Error())
-			} else {
-				os.Rename(configFile, configFile+`.`+time.Now().Format(`20060102150405`))
-				c.Conf.Fixed()
-				configContent, err := confl.Marshal(c.Conf)
-				if err != nil {
-					log.Fatal(err)
-					return
-				}
-				_, err = saveFile(configFile, configContent)
-				if err != nil {
-					log.Error(err)
-					return
-				}
-				log.Info("== Upgrade config file " + ConfigName)
-			}
-		} else {
-			log.Error(err.Error())
-		}
-	} else {
-		if strings.Contains(*c.Conf.Watch.IgnoredPath, `\\`) {
-			*c.Conf.Watch.IgnoredPath = strings.Replace(*c.Conf.Watch.IgnoredPath, `\\`, `\`, -1)
-		}
+		// 不要在配置文件有错误时使用默认设置启动
+		log.Error("== Invalid config:\n" + err.Error())
+		os.Exit(1)
 	}
-	c.Conf.Fixed()
-	if !allowBuild {
-		if len(*c.Conf.App.ExecFile) == 0 {
-			log.Error("请设置exec参数用来指定执行文件位置")
-			time.Sleep(time.Second * 10)
-			return
-		}
+	if !fileExist(configFile) {
+		log.Info("== Config file " + configFile + " does not exist, run `tower init` to generate one")
+	}
+	if err := ValidateConfig(configFile, allowBuild, c.Conf); err != nil {
+		log.Error("== Invalid config:\n" + err.Error())
+		os.Exit(1)
 	}
 	if *c.Conf.Verbose {
 		*c.Conf.LogLevel = `Debug`
 	}
 
 	log.DefaultLog.SetLevel(*c.Conf.LogLevel)
+	SetEditor(*c.Conf.Editor)
+	if *c.Conf.Page.SnippetLines > 0 {
+		SnippetLineNumbers = *c.Conf.Page.SnippetLines
+	}
+	Pages.Dir = *c.Conf.Page.TemplateDir
+	if len(*c.Conf.Page.Theme) > 0 {
+		PageTheme = *c.Conf.Page.Theme
+	}
 	if len(*c.Conf.Proxy.Port) > 0 {
 		err := dialAddress("127.0.0.1:"+*c.Conf.Proxy.Port, 1)
 		if err == nil {
@@ -281,10 +427,23 @@ func startTower() {
 		}
 		app = NewApp(*c.Conf.App.MainFile, *c.Conf.App.Port, *c.Conf.App.BuildDir, *c.Conf.App.PortParamName)
 	}
+	defer killAllOnPanic()
 	app.OfflineMode = *c.Conf.Offline
-	app.DisabledLogRequest = *c.Conf.LogRequest == false
-	if len(*c.Conf.App.RunParams) > 0 {
-		app.RunParams = strings.Split(*c.Conf.App.RunParams, ` `)
+	app.Type = *c.Conf.App.Type
+	app.HealthService = *c.Conf.App.HealthService
+	if len(*c.Conf.App.ConfigTemplate) > 0 {
+		app.ConfigTemplate, err = filepath.Abs(*c.Conf.App.ConfigTemplate)
+		mustSuccess(err)
+	}
+	if len(*c.Conf.App.SocketDir) > 0 {
+		mustSuccess(app.UseSocketDir(*c.Conf.App.SocketDir))
+		log.Info(`== Unix socket directory: ` + app.SocketDir)
+	}
+	if *c.Conf.App.SocketActivation {
+		listener, err := OpenActivationListener(`:` + *c.Conf.Proxy.Port)
+		mustSuccess(err)
+		app.Listener = listener
+		log.Info(`== Socket activation: listening on :` + *c.Conf.Proxy.Port)
 	}
 	watchedDir := app.Root
 	if !allowBuild {
@@ -297,10 +456,25 @@ func startTower() {
 	}
 	watcher := NewWatcher(watchedDir, *c.Conf.Watch.FileExtension, *c.Conf.Watch.IgnoredPath)
 	proxy := NewProxy(&app, &watcher)
-	proxy.AdminPwd = *c.Conf.Admin.Password
 	proxy.Engine = *c.Conf.Proxy.Engine
-	if len(*c.Conf.Admin.IPs) > 0 {
-		proxy.AdminIPs = strings.Split(*c.Conf.Admin.IPs, `,`)
+	proxy.Queue = NewBackendQueue(*c.Conf.Proxy.QueueSize, time.Duration(*c.Conf.Proxy.QueueTimeout)*time.Second)
+	proxy.HTTP2 = *c.Conf.Proxy.HTTP2
+	proxy.H2C = *c.Conf.Proxy.H2C
+	if *c.Conf.Proxy.BackendH2C || app.IsGRPC() {
+		proxy.Gateway.UseH2C()
+	}
+	if *c.Conf.Proxy.TLS.Enabled {
+		certs, err := NewCertificates(*c.Conf.Proxy.TLS.CertFile, *c.Conf.Proxy.TLS.KeyFile, strings.Split(*c.Conf.Proxy.TLS.Hosts, `,`), *c.Conf.Proxy.TLS.CADir)
+		mustSuccess(err)
+		proxy.TLS = certs
+		proxy.RedirectPort = *c.Conf.Proxy.TLS.RedirectPort
+	} else if app.IsGRPC() {
+		proxy.H2C = true
+	}
+	mustSuccess(applyConfig(c.Conf, &app, &proxy))
+	proxy.Maintenance = NewMaintenance(*c.Conf.Maintenance.StateFile, *c.Conf.Maintenance.Message, *c.Conf.Maintenance.RetryAfter)
+	if *c.Conf.Capture.Enabled {
+		proxy.Recorder = NewRequestRecorder(*c.Conf.Capture.MaxBodySize, *c.Conf.Capture.MaxRequests)
 	}
 	if allowBuild {
 		watcher.OnChanged = func(file string) {
@@ -364,8 +538,34 @@ func startTower() {
 		app.DisabledBuild = true
 	}
 	proxy.Port = *c.Conf.Proxy.Port
+	reloader, err := NewConfigReloader(configFile, allowBuild, &app, &proxy)
+	mustSuccess(err)
 	go func() {
-		mustSuccess(watcher.Watch())
+		defer killAllOnPanic()
+		reloader.Watch()
+	}()
+	signals := &SignalHandler{
+		Exit: func() {
+			app.StopAll()
+			os.Exit(0)
+		},
+		Reload: reloader.Reload,
+		Rebuild: func() error {
+			if !allowBuild {
+				return app.Restart()
+			}
+			port, err := getPort()
+			if err != nil {
+				return err
+			}
+			return app.Start(true, port)
+		},
+		Restart: app.Restart,
+	}
+	signals.Listen()
+	go func() {
+		defer killAllOnPanic()
+		exitOnError(watcher.Watch())
 	}()
 	err = app.Start(true, app.Port)
 	if err != nil {
@@ -374,6 +574,25 @@ func startTower() {
 	mustSuccess(proxy.Listen())
 }
 
+// killAllOnPanic Tower异常退出时不要留下仍在运行的程序。
+// recover只对当前goroutine有效，startTower启动的goroutine也需要defer调用
+func killAllOnPanic() {
+	if e := recover(); e != nil {
+		app.KillAll()
+		panic(e)
+	}
+}
+
+// exitOnError 用于goroutine中无法继续运行的错误：结束所有程序后退出
+func exitOnError(err error) {
+	if err == nil {
+		return
+	}
+	log.Error(err)
+	app.KillAll()
+	os.Exit(1)
+}
+
 func getPort() (port string, err error) {
 	port = app.Port
 	if !app.DisabledVisitPort() {
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/admpub/log"
+)
+
+const (
+	ErrorTypeMaintenance = "maintenance"
+
+	MaintenanceBypassCookie      = "tower_maintenance_bypass"
+	DefaultMaintenanceMessage    = "The site is under maintenance, please try again later."
+	DefaultMaintenanceRetryAfter = 300
+	DefaultMaintenanceStateFile  = ".tower-maintenance.json"
+)
+
+// Maintenance 维护模式。开启后除管理员IP和带有绕过cookie的请求外，都会返回503维护页面。
+// 状态保存在StateFile中，Tower重启后依然有效
+type Maintenance struct {
+	Enabled    bool      `json:"enabled"`
+	Message    string    `json:"message"`
+	RetryAfter int       `json:"retryAfter"` //秒
+	Token      string    `json:"token"`      //绕过cookie的值，每次开启时重新生成
+	Since      time.Time `json:"since"`
+	StateFile  string    `json:"-"`
+	mu         sync.RWMutex
+}
+
+// NewMaintenance message和retryAfter为默认设置，StateFile中保存的状态优先
+func NewMaintenance(stateFile string, message string, retryAfter int) *Maintenance {
+	if len(stateFile) == 0 {
+		stateFile = DefaultMaintenanceStateFile
+	}
+	if len(message) == 0 {
+		message = DefaultMaintenanceMessage
+	}
+	if retryAfter <= 0 {
+		retryAfter = DefaultMaintenanceRetryAfter
+	}
+	m := &Maintenance{
+		Message:    message,
+		RetryAfter: retryAfter,
+		StateFile:  stateFile,
+	}
+	m.load()
+	return m
+}
+
+func (this *Maintenance) load() {
+	b, err := ioutil.ReadFile(this.StateFile)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(b, this); err != nil {
+		log.Error(`== Fail to load maintenance state: `, err)
+		return
+	}
+	if this.Enabled {
+		log.Warn(`== Maintenance mode is on (since ` + this.Since.Format(`2006-01-02 15:04:05`) + `)`)
+	}
+}
+
+func (this *Maintenance) save() error {
+	b, err := json.MarshalIndent(this, ``, `  `)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(this.StateFile, b, 0600)
+}
+
+// Enable 开启维护模式。message和retryAfter为空时使用上一次的设置
+func (this *Maintenance) Enable(message string, retryAfter int) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if len(message) > 0 {
+		this.Message = message
+	}
+	if retryAfter > 0 {
+		this.RetryAfter = retryAfter
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	this.Token = hex.EncodeToString(token)
+	this.Enabled = true
+	this.Since = time.Now()
+	log.Warn(`== Maintenance mode on`)
+	return this.save()
+}
+
+func (this *Maintenance) Disable() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.Enabled = false
+	this.Token = ``
+	log.Warn(`== Maintenance mode off`)
+	if err := os.Remove(this.StateFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (this *Maintenance) IsEnabled() bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.Enabled
+}
+
+// Bypassed 请求是否带有有效的绕过cookie
+func (this *Maintenance) Bypassed(ctx Context) bool {
+	this.mu.RLock()
+	token := this.Token
+	this.mu.RUnlock()
+	if len(token) == 0 {
+		return false
+	}
+	r := &http.Request{Header: http.Header{`Cookie`: {requestHeader(ctx, `Cookie`)}}}
+	cookie, err := r.Cookie(MaintenanceBypassCookie)
+	return err == nil && cookie.Value == token
+}
+
+// BypassCookie 返回用于绕过维护模式的Set-Cookie值
+func (this *Maintenance) BypassCookie() string {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	cookie := &http.Cookie{
+		Name:     MaintenanceBypassCookie,
+		Value:    this.Token,
+		Path:     `/`,
+		HttpOnly: true,
+	}
+	return cookie.String()
+}
+
+func (this *Maintenance) Status() string {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	if !this.Enabled {
+		return `maintenance status: Off`
+	}
+	return `maintenance status: On (since ` + this.Since.Format(`2006-01-02 15:04:05`) + `)`
+}
+
+func RenderMaintenance(ctx Context, app *App, m *Maintenance) {
+	m.mu.RLock()
+	message, retryAfter := m.Message, m.RetryAfter
+	m.mu.RUnlock()
+	info := ErrorInfo{Title: "Maintenance", Type: ErrorTypeMaintenance, StatusCode: 503, Message: template.HTML(template.HTMLEscapeString(message)), text: message}
+	info.Prepare(app)
+	if retryAfter > 0 {
+		ctx.SetHeader(`Retry-After`, strconv.Itoa(retryAfter))
+	}
+	renderPage(ctx, info)
+}
@@ -1,179 +1,385 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"html"
 	"html/template"
 	"io/ioutil"
-	"os"
+	"math"
+	"net/http"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/webx-top/reverseproxy"
+	"github.com/admpub/log"
 )
 
-var errorTemplate *template.Template
+var (
+	requestsTemplate *template.Template
+	replayTemplate   *template.Template
+)
 
 func init() {
-	templatePath := filepath.Join(SelfDir(), "page.html")
+	funcMap := template.FuncMap{"headerLines": headerLines}
+	requestsTemplate = template.Must(template.New(`requests`).Funcs(funcMap).Parse(requestsPageHTML))
+	replayTemplate = template.Must(template.New(`replay`).Funcs(funcMap).Parse(replayPageHTML))
+}
 
-	_, err := os.Stat(templatePath)
-	if err == nil {
-		errorTemplate, err = template.ParseFiles(templatePath)
-	} else {
-		errorTemplate = template.New(`defaultPage`)
-		_, err = errorTemplate.Parse(defaultPageHTML)
-	}
+const (
+	ErrorTypeApp     = "app_error"
+	ErrorTypeBuild   = "build_error"
+	ErrorTypeAppDown = "app_down"
+)
 
-	if err != nil {
-		panic(err)
-	}
+// errorPages 错误类型对应的页面模板
+var errorPages = map[string]string{
+	ErrorTypeApp:         PageAppError,
+	ErrorTypeBuild:       PageBuildError,
+	ErrorTypeAppDown:     PageAppDown,
+	ErrorTypeMaintenance: PageMaintenance,
+}
+
+func RenderError(ctx Context, app *App, message string) {
+	renderError(ctx, app, message, 502)
 }
 
-func RenderError(ctx reverseproxy.Context, app *App, message string) {
-	info := ErrorInfo{Title: "Error", Message: template.HTML(message)}
-	info.Prepare()
+// RenderUnavailable 等待程序启动超时等暂时无法提供服务时使用
+func RenderUnavailable(ctx Context, app *App, message string) {
+	renderError(ctx, app, message, 503)
+}
+
+func renderError(ctx Context, app *App, message string, statusCode int) {
+	info := ErrorInfo{Title: "Error", Type: ErrorTypeAppDown, StatusCode: statusCode, Message: template.HTML(message), text: message}
+	info.Prepare(app)
 
 	renderPage(ctx, info)
 }
 
-func RenderBuildError(ctx reverseproxy.Context, app *App, message string) {
-	info := ErrorInfo{Title: "Build Error", Message: template.HTML(message)}
-	info.Prepare()
+func RenderBuildError(ctx Context, app *App, message string) {
+	info := ErrorInfo{Title: "Build Error", Type: ErrorTypeBuild, StatusCode: 503, Message: template.HTML(html.EscapeString(message)), text: message}
+	info.Diagnostics = parseBuildDiagnostics(message)
+	for i, d := range info.Diagnostics {
+		file, _ := filepath.Abs(d.File) // go build输出的路径相对于当前工作目录
+		info.Diagnostics[i].URL = EditorURL(app.Module(), file, d.Line)
+	}
+	info.Prepare(app)
 
 	renderPage(ctx, info)
 }
 
-const SnippetLineNumbers = 13
+// SnippetLineNumbers 错误页面中每段源码显示的行数
+var SnippetLineNumbers = 13
+
+var httpPanicPrefixRegexp = regexp.MustCompile(`.*` + regexp.QuoteMeta(HttpPanicMessage) + ` \S+: `)
 
-func RenderAppError(ctx reverseproxy.Context, app *App, errMessage string) {
-	info := ErrorInfo{Title: "Application Error"}
-	message, trace, appIndex := extractAppErrorInfo(errMessage)
+func RenderAppError(ctx Context, app *App, errMessage string) {
+	info := ErrorInfo{Title: "Application Error", Type: ErrorTypeApp, StatusCode: 500}
+	message, trace, appIndex := extractAppErrorInfo(errMessage, app.Module())
+	if len(message) == 0 {
+		message = []string{"Unknown error"}
+	}
 
 	// from: 2013/02/12 18:24:15 http: panic serving 127.0.0.1:54114: Validation Error
 	//   to: Validation Error
-	message[0] = string(regexp.MustCompile(`.+\d+\.\d+.\d+.\d+\:\d+\: `).ReplaceAll([]byte(message[0]), []byte("")))
-	if !strings.Contains(message[0], "runtime error") {
+	message[0] = httpPanicPrefixRegexp.ReplaceAllString(message[0], "")
+	if !strings.Contains(message[0], "runtime error") && !strings.HasPrefix(message[0], "panic: ") && !strings.HasPrefix(message[0], "fatal error: ") {
 		message[0] = "panic: " + message[0]
 	}
 
-	info.Message = template.HTML(strings.Join(message, "\n"))
+	info.text = strings.Join(message, "\n")
+	info.Message = template.HTML(html.EscapeString(info.text))
 	info.Trace = trace
-	info.ShowTrace = true
+	info.ShowTrace = len(trace) > 0
 
-	// from: test/server1.go:16 (0x211e)
-	//	 to: [test/server1.go, 16]
-	appFileInfo := strings.Split(strings.Split(trace[appIndex].File, " ")[0], ":")
-	info.SnippetPath = appFileInfo[0]
-	info.ShowSnippet = true
-	curLineNum, _ := strconv.ParseInt(appFileInfo[1], 10, 16)
-	info.Snippet = extractAppSnippet(appFileInfo[0], int(curLineNum))
+	sources := map[string][]template.HTML{}
+	for i, t := range trace {
+		if !t.AppFile {
+			continue
+		}
+		block := SnippetBlock{Path: t.File, Func: t.Func, URL: t.URL, Open: i == appIndex}
+		lines, ok := sources[t.Path]
+		if !ok {
+			lines = readHighlightedSource(t.Path)
+			sources[t.Path] = lines
+		}
+		block.Lines, block.Error = extractAppSnippet(lines, t.Line)
+		for j, s := range block.Lines {
+			block.Lines[j].URL = EditorURL(app.Module(), t.Path, s.Number)
+		}
+		if i == appIndex && len(block.Lines) > 0 {
+			info.SnippetPath = block.Path
+			info.SnippetURL = block.URL
+			info.Snippet = block.Lines
+			info.ShowSnippet = true
+		}
+		info.Snippets = append(info.Snippets, block)
+	}
 
-	info.Prepare()
+	info.Prepare(app)
 	renderPage(ctx, info)
 }
 
-func renderPage(ctx reverseproxy.Context, info ErrorInfo) {
+func renderPage(ctx Context, info ErrorInfo) {
+	if isGRPCRequest(ctx) {
+		renderGRPCError(ctx, info.text)
+		return
+	}
+	if info.StatusCode > 0 {
+		ctx.SetStatusCode(info.StatusCode)
+	}
+	if wantsJSON(ctx) {
+		ctx.SetHeader(`Content-Type`, `application/json;charset=utf-8`)
+		b, err := json.Marshal(info.JSON())
+		if err != nil {
+			log.Error(`== Fail to encode the error page: `, err)
+			ctx.SetStatusCode(500)
+			ctx.SetHeader(`Content-Type`, `text/plain;charset=utf-8`)
+			ctx.SetBody([]byte(http.StatusText(500)))
+			return
+		}
+		ctx.SetBody(b)
+		return
+	}
+	page, ok := errorPages[info.Type]
+	if !ok {
+		page = PageFallback
+	}
 	ctx.SetHeader(`Content-Type`, `text/html;charset=utf-8`)
-	err := errorTemplate.Execute(ctx.ResponseWriter(), info)
+	buf := new(bytes.Buffer)
+	tmpl := Pages.Get(page)
+	err := tmpl.Execute(buf, info)
 	if err != nil {
-		panic(err)
+		// 自定义模板执行出错时使用默认模板
+		log.Error(`== Fail to render template `+tmpl.Name()+`: `, err)
+		buf.Reset()
+		err = defaultPageTemplate(page).Execute(buf, info)
 	}
+	if err != nil {
+		log.Error(`== Fail to render the error page: `, err)
+		ctx.SetStatusCode(500)
+		ctx.SetHeader(`Content-Type`, `text/plain;charset=utf-8`)
+		ctx.SetBody([]byte(info.text))
+		return
+	}
+	ctx.SetBody(buf.Bytes())
+}
+
+// wantsJSON 根据Accept、X-Requested-With和Sec-Fetch-Dest判断客户端是否期望JSON格式
+func wantsJSON(ctx Context) bool {
+	if strings.EqualFold(requestHeader(ctx, `X-Requested-With`), `XMLHttpRequest`) {
+		return true
+	}
+	htmlQ, jsonQ := acceptQuality(requestHeader(ctx, `Accept`))
+	if htmlQ > 0 && htmlQ >= jsonQ {
+		return false
+	}
+	if jsonQ > 0 {
+		return true
+	}
+	// fetch()默认的Accept为“*/*”，但会带上Sec-Fetch-Dest: empty
+	dest := requestHeader(ctx, `Sec-Fetch-Dest`)
+	return len(dest) > 0 && dest != `document` && dest != `iframe`
+}
+
+// acceptQuality 返回Accept中HTML和JSON的权重。“*/*”只有在没有明确指定HTML时才算作JSON
+func acceptQuality(accept string) (htmlQ float64, jsonQ float64) {
+	var anyQ float64
+	for _, part := range strings.Split(accept, `,`) {
+		params := strings.Split(part, `;`)
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, `q=`) {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		switch {
+		case mediaType == `text/html` || mediaType == `application/xhtml+xml`:
+			htmlQ = math.Max(htmlQ, q)
+		case mediaType == `application/json` || strings.HasSuffix(mediaType, `+json`):
+			jsonQ = math.Max(jsonQ, q)
+		case mediaType == `*/*`:
+			anyQ = math.Max(anyQ, q)
+		}
+	}
+	if htmlQ == 0 && jsonQ == 0 && anyQ > 0 {
+		jsonQ = anyQ
+	}
+	return
 }
 
 // Example input
 // 2013/02/12 18:24:15 http: panic serving 127.0.0.1:54114: Panic !!
-// /usr/local/Cellar/go/1.0.3/src/pkg/net/http/server.go:589 (0x31ed9)
-// _func_004: buf.Write(debug.Stack())
-// /usr/local/Cellar/go/1.0.3/src/pkg/runtime/proc.c:1443 (0x10b83)
-// panic: reflect·call(d->fn, d->args, d->siz);
-// /Users/user/tower/test/server1.go:16 (0x211e)
-// Panic: panic(errors.New("Panic !!"))
+// goroutine 5 [running]:
+// net/http.(*conn).serve.func1()
+// 	/usr/local/go/src/net/http/server.go:1898 +0xbe
+// panic({0x6c8f00?, 0xc00009e000?})
+// 	/usr/local/go/src/runtime/panic.go:770 +0x132
+// main.Panic({0x7f1c58?, 0xc0000ba000?}, 0x0?)
+// 	/Users/user/tower/test/server1.go:36 +0x45
 
 // Example output
 // message:
 //	[2013/02/12 18:24:15 http: panic serving 127.0.0.1:54114: Panic !!]
 // trace:
 //  [
-//	 [test/server1.go:16 (0x211e), Panic: panic(errors.New("Panic !!"))]
+//	 {File: net/http/server.go:1898, Func: net/http.(*conn).serve.func1},
+//	 {File: runtime/panic.go:770, Func: panic},
+//	 {File: test/server1.go:36, Func: main.Panic, AppFile: true},
 //	]
-func extractAppErrorInfo(errMessage string) (message []string, trace []Trace, appIndex int) {
-	// from: /Users/user/tower/test/server1.go:16 (0x211e)
-	// 		   Panic: panic(errors.New("Panic !!"))
-	//   to: <n>//Users/user/tower/test/server1.go:16 (0x211e)<n>Panic: panic(errors.New("Panic !!"))
-	errMessage = strings.Replace(strings.Replace(errMessage, "\n", "<n>", -1), "<n>/", "<n>//", -1)
-
-	wd, _ := os.Getwd()
-	wd = wd + "/"
-	for i, line := range strings.Split(errMessage, "<n>/") {
-		lines := strings.Split(line, "<n>")
-		if i == 0 {
-			message = lines
-			continue
+// appIndex:
+//	2
+func extractAppErrorInfo(errMessage string, mod *GoModule) (message []string, trace []Trace, appIndex int) {
+	appIndex = -1
+	stack := ParseStack(errMessage)
+	stack.MarkFrames(mod)
+	message = stack.Message
+	g := stack.Current()
+	if g == nil {
+		return
+	}
+	goroot := filepath.ToSlash(runtime.GOROOT()) + "/src/"
+	for _, f := range g.Frames {
+		t := Trace{Func: f.Func, Path: f.File, Line: f.Line, AppFile: f.AppFile}
+		if f.CreatedBy {
+			t.Func = "created by " + f.Func
 		}
-
-		t := Trace{Func: lines[1]}
-		if strings.Index(lines[0], wd) != -1 {
-			if appIndex == 0 {
-				appIndex = i - 1
-			}
-			t.AppFile = true
+		file := filepath.ToSlash(f.File)
+		switch {
+		case f.AppFile && mod != nil:
+			t.Path = mod.Abs(f.File)
+			file = mod.Rel(f.File)
+		case f.Stdlib:
+			file = strings.TrimPrefix(file, goroot)
+		}
+		if len(file) > 0 {
+			t.File = file + ":" + strconv.Itoa(f.Line)
+			t.URL = EditorURL(mod, t.Path, t.Line)
+		}
+		if f.AppFile && appIndex == -1 {
+			appIndex = len(trace)
 		}
-		t.File = strings.Replace(lines[0], wd, "", 1)
-		// from: /Users/user/tower/test/server1.go:16 (0x211e)
-		//   to: /Users/user/tower/test/server1.go:16
-		t.File = string(regexp.MustCompile(`\(.+\)$`).ReplaceAll([]byte(t.File), []byte("")))
 		trace = append(trace, t)
 	}
 	return
 }
 
-func extractAppSnippet(appFile string, curLineNum int) (snippet []Snippet) {
-	content, err := ioutil.ReadFile(appFile)
+// readHighlightedSource 读取源文件并着色，文件不存在时返回nil
+func readHighlightedSource(file string) []template.HTML {
+	content, err := ioutil.ReadFile(file)
 	if err != nil {
-		panic(err)
-	}
-	lines := strings.Split(string(content), "\n")
-	for lineNum := curLineNum - SnippetLineNumbers/2; lineNum <= curLineNum+SnippetLineNumbers/2; lineNum++ {
-		if len(lines) >= lineNum {
-			c := html.EscapeString(lines[lineNum-1])
-			c = strings.Replace(c, "\t", "&nbsp;&nbsp;&nbsp;&nbsp;", -1)
-			c = strings.Replace(c, " ", "&nbsp;", -1)
-			snippet = append(snippet, Snippet{lineNum, template.HTML(c), lineNum == curLineNum})
-		}
+		return nil
+	}
+	return highlightGo(content)
+}
+
+func extractAppSnippet(lines []template.HTML, curLineNum int) (snippet []Snippet, errMessage string) {
+	if lines == nil {
+		return nil, "source file is not available"
+	}
+	if curLineNum < 1 || curLineNum > len(lines) {
+		return nil, "line " + strconv.Itoa(curLineNum) + " is out of range"
+	}
+	start := curLineNum - SnippetLineNumbers/2
+	if start < 1 {
+		start = 1
+	}
+	end := curLineNum + SnippetLineNumbers/2
+	if end > len(lines) {
+		end = len(lines)
+	}
+	for lineNum := start; lineNum <= end; lineNum++ {
+		snippet = append(snippet, Snippet{Number: lineNum, Code: lines[lineNum-1], Current: lineNum == curLineNum})
 	}
 	return
 }
 
 type ErrorInfo struct {
-	Title   string
-	Time    string
-	Message template.HTML
+	Title      string
+	Type       string
+	StatusCode int
+	Time       string
+	Message    template.HTML
+	text       string //未转为HTML的原始信息
+
+	Diagnostics []Diagnostic //编译错误
+
+	App AppMeta
 
 	Trace     []Trace
 	ShowTrace bool
 
 	SnippetPath string
+	SnippetURL  template.URL
 	Snippet     []Snippet
 	ShowSnippet bool
+
+	Snippets []SnippetBlock //所有属于当前项目的帧的源码
+}
+
+// SnippetBlock 某一帧附近的源码
+type SnippetBlock struct {
+	Path  string
+	Func  string
+	URL   template.URL
+	Lines []Snippet
+	Error string
+	Open  bool //是否默认展开
 }
 
 type Snippet struct {
 	Number  int
 	Code    template.HTML
 	Current bool
+	URL     template.URL
 }
 
 type Trace struct {
-	File    string
+	File    string //用于显示的路径，例如：test/server1.go:16
 	Func    string
+	Path    string //文件的完整路径
+	Line    int
+	URL     template.URL //在编辑器中打开的链接
 	AppFile bool
 }
 
-func (this *ErrorInfo) Prepare() {
+// JSON 返回给API客户端的错误信息
+func (this *ErrorInfo) JSON() map[string]interface{} {
+	frames := []map[string]interface{}{}
+	for _, t := range this.Trace {
+		frames = append(frames, map[string]interface{}{
+			"func":    t.Func,
+			"file":    t.Path,
+			"line":    t.Line,
+			"appFile": t.AppFile,
+		})
+	}
+	diagnostics := this.Diagnostics
+	if diagnostics == nil {
+		diagnostics = []Diagnostic{}
+	}
+	return map[string]interface{}{
+		"type":        this.Type,
+		"title":       this.Title,
+		"status":      this.StatusCode,
+		"message":     this.text,
+		"time":        this.Time,
+		"trace":       frames,
+		"diagnostics": diagnostics,
+		"app":         this.App,
+	}
+}
+
+func (this *ErrorInfo) Prepare(app *App) {
 	this.TrimMessage()
+	this.App = app.Meta()
 	this.Time = time.Now().Format("15:04:05")
 }
 
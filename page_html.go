@@ -1,8 +1,57 @@
 package main
 
-var defaultPageHTML = `<html>
+// 默认模板的配色，dark主题和auto主题在系统为深色模式时使用深色
+const themeCSS = `
+      .theme-light, .theme-auto, .theme-dark{
+        --bg: #FFFFFF;
+        --fg: #222222;
+        --header-bg: #D8E5F2;
+        --border: #D8E5F2;
+        --muted: #929292;
+        --current-bg: #FCF3CF;
+        --kw: #A626A4;
+        --str: #50A14F;
+        --num: #986801;
+        --com: #A0A1A7;
+        --bi: #0184BC;
+      }
+      .theme-dark{
+        --bg: #1E1F22;
+        --fg: #DCDCDC;
+        --header-bg: #2B3A4A;
+        --border: #3A4556;
+        --muted: #8C8C8C;
+        --current-bg: #3D3A24;
+        --kw: #C678DD;
+        --str: #98C379;
+        --num: #D19A66;
+        --com: #7F848E;
+        --bi: #56B6C2;
+      }
+      @media (prefers-color-scheme: dark){
+        .theme-auto{
+          --bg: #1E1F22;
+          --fg: #DCDCDC;
+          --header-bg: #2B3A4A;
+          --border: #3A4556;
+          --muted: #8C8C8C;
+          --current-bg: #3D3A24;
+          --kw: #C678DD;
+          --str: #98C379;
+          --num: #D19A66;
+          --com: #7F848E;
+          --bi: #56B6C2;
+        }
+      }
+      body{
+        background-color: var(--bg);
+        color: var(--fg);
+      }
+`
+
+var defaultPageHTML = `<html class="theme-{{theme}}">
   <head>
-    <style>
+    <style>` + themeCSS + `
       *{
         font-family: Helvetica Neue, Arial, Verdana, sans-serif;
       }
@@ -12,7 +61,7 @@ var defaultPageHTML = `<html>
       .header{
         width:100%;
         height: 70px;
-        background-color: #D8E5F2;
+        background-color: var(--header-bg);
       }
       h1{
         font-size: 30px;
@@ -38,7 +87,7 @@ var defaultPageHTML = `<html>
       .snippet, .trace{
         margin-left: -15px;
         padding:14px;
-        border: 1px solid #D8E5F2;
+        border: 1px solid var(--border);
         border-radius: 5px;
         -moz-border-radius: 5px;
         -webkit-border-radius: 5px;
@@ -48,11 +97,42 @@ var defaultPageHTML = `<html>
       .numbers, .codes{
         line-height: 22px;
       }
+      .codes{
+        overflow-x: auto;
+      }
+      .codes .line{
+        display: inline-block;
+        min-width: 100%;
+        white-space: pre;
+        tab-size: 4;
+        -moz-tab-size: 4;
+        font-family: Menlo, Consolas, monospace;
+      }
+      .codes .current{
+        background-color: var(--current-bg);
+        font-weight: bold;
+      }
+      .codes .kw{ color: var(--kw); }
+      .codes .str{ color: var(--str); }
+      .codes .num{ color: var(--num); }
+      .codes .com{ color: var(--com); font-style: italic; }
+      .codes .bi{ color: var(--bi); }
+
+      .source summary{
+        cursor: pointer;
+        font-size: 16px;
+        font-weight: bold;
+        margin-bottom: 10px;
+      }
+      .source .func{
+        font-weight: normal;
+        color: var(--muted);
+      }
       .numbers{
         float:left;
         text-align: right;
         margin-right: 15px;
-        color: #929292;
+        color: var(--muted);
       }
 
       .trace ul{
@@ -65,13 +145,27 @@ var defaultPageHTML = `<html>
       }
 
       .trace .func{
-        color: #929292;
+        color: var(--muted);
+      }
+
+      .footer{
+        margin: 30px 0;
+        color: var(--muted);
+        font-size: 12px;
       }
 
       .clearfix{
         clear: both;
       }
 
+      a{
+        color: inherit;
+        text-decoration: none;
+      }
+      a:hover{
+        text-decoration: underline;
+      }
+
     </style>
   </head>
   <body>
@@ -84,33 +178,51 @@ var defaultPageHTML = `<html>
         {{.Message}}
       </div>
 
-
-      {{if .ShowSnippet}}
-      <h2>{{.SnippetPath}}</h2>
-      <div class="snippet">
-        <div class="numbers">
-          {{range .Snippet}}
-            {{if .Current}}
-              <strong>{{.Number}}</strong>
-            {{else}}
-              {{.Number}}
-            {{end}}
+      {{if .Diagnostics}}
+      <h2>Diagnostics</h2>
+      <div class="trace">
+        <ul>
+          {{range .Diagnostics}}
+          <li>
+            {{if .URL}}<a href="{{.URL}}">{{end}}<strong>{{.File}}:{{.Line}}{{if .Column}}:{{.Column}}{{end}}</strong>{{if .URL}}</a>{{end}}
             <br/>
+            <span class="func">{{.Message}}</span>
+          </li>
           {{end}}
-        </div>
+        </ul>
+      </div>
+      {{end}}
+
 
-        <div class="codes">
-          {{range .Snippet}}
-            {{if .Current}}
-              <strong>{{.Code}}</strong>
-            {{else}}
-              {{.Code}}
+      {{range .Snippets}}
+      <details class="source"{{if .Open}} open{{end}}>
+        <summary>{{if .URL}}<a href="{{.URL}}">{{.Path}}</a>{{else}}{{.Path}}{{end}} <span class="func">{{.Func}}</span></summary>
+        <div class="snippet">
+          {{if .Error}}
+          <span class="func">{{.Error}}</span>
+          {{else}}
+          <div class="numbers">
+            {{range .Lines}}
+              {{if .URL}}<a href="{{.URL}}">{{end}}
+              {{if .Current}}
+                <strong>{{.Number}}</strong>
+              {{else}}
+                {{.Number}}
+              {{end}}
+              {{if .URL}}</a>{{end}}
+              <br/>
             {{end}}
-            <br/>
+          </div>
+
+          <div class="codes">
+            {{range .Lines}}
+              <span class="line{{if .Current}} current{{end}}">{{.Code}}</span><br/>
+            {{end}}
+          </div>
+          <div class="clearfix"></div>
           {{end}}
         </div>
-        <div class="clearfix"></div>
-      </div>
+      </details>
       {{end}}
 
 
@@ -120,12 +232,14 @@ var defaultPageHTML = `<html>
         <ul>
           {{range .Trace}}
           <li>
+            {{if .URL}}<a href="{{.URL}}">{{end}}
             {{if .AppFile}}
               <strong>{{.File}}</strong>
             {{end}}
             {{if not .AppFile}}
               {{.File}}
             {{end}}
+            {{if .URL}}</a>{{end}}
             <br/>
             <span class="func">{{.Func}}</span>
           </li>
@@ -133,6 +247,107 @@ var defaultPageHTML = `<html>
         </ul>
       </div>
       {{end}}
+
+      <div class="footer">
+        {{.App.Name}}{{if .App.Version}} v{{.App.Version}}{{end}}{{if .App.Port}} · port {{.App.Port}}{{end}}{{if .App.Uptime}} · uptime {{.App.Uptime}}{{end}}
+      </div>
+    </div>
+  </body>
+</html>
+`
+
+var defaultMaintenanceHTML = `<html class="theme-{{theme}}">
+  <head>
+    <title>{{.Title}}</title>
+    <style>` + themeCSS + `
+      *{
+        font-family: Helvetica Neue, Arial, Verdana, sans-serif;
+      }
+      body{
+        margin: 0;
+      }
+      .content{
+        width: 600px;
+        margin: 120px auto;
+        text-align: center;
+      }
+      h1{
+        font-size: 30px;
+      }
+      .message{
+        color: var(--muted);
+        line-height: 24px;
+      }
+    </style>
+  </head>
+  <body>
+    <div class="content">
+      <h1>{{.Title}}</h1>
+      <div class="message">{{.Message}}</div>
+    </div>
+  </body>
+</html>
+`
+
+var requestsPageHTML = `<html>
+  <head>
+    <title>Tower - Failed Requests</title>
+    <style>
+      *{ font-family: Helvetica Neue, Arial, Verdana, sans-serif; }
+      body{ margin: 0; }
+      .header{ width:100%; height: 70px; background-color: #D8E5F2; }
+      h1{ font-size: 30px; line-height: 70px; width: 880px; margin: 0 auto; padding-left: 20px; }
+      .content{ width: 880px; margin: 0 auto; padding-left:20px; }
+      .request{ margin: 20px 0; padding:14px; border: 1px solid #D8E5F2; border-radius: 5px; }
+      .request pre{ white-space: pre-wrap; word-break: break-all; color: #555; }
+      .meta{ color: #929292; }
+    </style>
+  </head>
+  <body>
+    <div class="header">
+      <h1>Failed Requests</h1>
+    </div>
+    <div class="content">
+      {{range .Requests}}
+      <div class="request">
+        <strong>#{{.ID}} {{.Method}} {{.URI}}</strong>
+        <span class="meta">{{.Time.Format "15:04:05"}} {{if .StatusCode}}status {{.StatusCode}}{{end}}</span>
+        <a href="/tower-proxy/requests/replay?id={{.ID}}{{if $.Pwd}}&pwd={{$.Pwd}}{{end}}">Replay against current build</a>
+        {{if .Error}}<pre>{{.Error}}</pre>{{end}}
+        <pre>{{headerLines .Header}}</pre>
+        {{if .Body}}<pre>{{printf "%s" .Body}}{{if .Truncated}} ...(truncated){{end}}</pre>{{end}}
+      </div>
+      {{else}}
+      <p>No failed requests captured.</p>
+      {{end}}
+    </div>
+  </body>
+</html>
+`
+
+var replayPageHTML = `<html>
+  <head>
+    <title>Tower - Replay</title>
+    <style>
+      *{ font-family: Helvetica Neue, Arial, Verdana, sans-serif; }
+      body{ margin: 0; }
+      .header{ width:100%; height: 70px; background-color: {{if .Fixed}}#DFF2D8{{else}}#F2D8D8{{end}}; }
+      h1{ font-size: 30px; line-height: 70px; width: 880px; margin: 0 auto; padding-left: 20px; }
+      .content{ width: 880px; margin: 0 auto; padding-left:20px; }
+      pre{ white-space: pre-wrap; word-break: break-all; padding:14px; border: 1px solid #D8E5F2; border-radius: 5px; }
+    </style>
+  </head>
+  <body>
+    <div class="header">
+      <h1>{{if .Fixed}}Fixed{{else}}Still failing{{end}} -- #{{.Request.ID}} {{.Request.Method}} {{.Request.URI}}</h1>
+    </div>
+    <div class="content">
+      <p>Backend: {{.Backend}} &nbsp; Duration: {{.Duration}} {{if .StatusCode}}&nbsp; Status: {{.StatusCode}}{{end}}</p>
+      {{if .Error}}<h2>Error</h2><pre>{{.Error}}</pre>{{end}}
+      {{if .AppError}}<h2>Application Error</h2><pre>{{.AppError.Message}}</pre>{{end}}
+      {{if .Header}}<h2>Response</h2><pre>{{headerLines .Header}}</pre>{{end}}
+      {{if .Body}}<pre>{{.Body}}</pre>{{end}}
+      <p><a href="/tower-proxy/requests">Back</a></p>
     </div>
   </body>
 </html>
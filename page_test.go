@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAcceptQuality(t *testing.T) {
+	cases := []struct {
+		accept string
+		json   bool
+	}{
+		{"", false},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false},
+		{"application/json", true},
+		{"application/problem+json", true},
+		{"*/*", true},
+		{"text/html;q=0.5, application/json", true},
+		{"text/html, application/json", false},
+	}
+	for _, c := range cases {
+		htmlQ, jsonQ := acceptQuality(c.accept)
+		if got := jsonQ > 0 && jsonQ > htmlQ; got != c.json {
+			t.Errorf("%q: expected json=%v, got html=%v json=%v", c.accept, c.json, htmlQ, jsonQ)
+		}
+	}
+}
+
+func TestParseBuildDiagnostics(t *testing.T) {
+	diagnostics := parseBuildDiagnostics("# example.com/app\n./main.go:10:5: undefined: foo\nhandler/do.go:3:2: cannot use x (variable of type int) as string value in return statement\n\thave (int)\n\twant (string)\n")
+	if len(diagnostics) != 2 {
+		t.Fatalf("expected 2 diagnostics, got %+v", diagnostics)
+	}
+	if d := diagnostics[0]; d.File != "main.go" || d.Line != 10 || d.Column != 5 || d.Message != "undefined: foo" {
+		t.Errorf("unexpected diagnostic: %+v", d)
+	}
+	if d := diagnostics[1]; d.File != "handler/do.go" || d.Message != "cannot use x (variable of type int) as string value in return statement\nhave (int)\nwant (string)" {
+		t.Errorf("unexpected diagnostic: %+v", d)
+	}
+}
+
+func TestDefaultPageTemplates(t *testing.T) {
+	info := ErrorInfo{Title: "Application Error", Type: ErrorTypeApp, StatusCode: 500, Message: "panic: oops"}
+	info.Snippets = []SnippetBlock{{Path: "main.go:3", Open: true, Lines: []Snippet{{Number: 3, Code: "x", Current: true}}}}
+	for _, name := range []string{PageAppError, PageMaintenance} {
+		buf := new(bytes.Buffer)
+		if err := NewPageTemplates("").Get(name).Execute(buf, info); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if !strings.Contains(buf.String(), `class="theme-auto"`) {
+			t.Errorf("%s: theme class is missing", name)
+		}
+	}
+}
+
+func TestRenderPageTemplateError(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `tower-page`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// 可以解析，但执行时出错(没有这个字段)
+	if err := ioutil.WriteFile(filepath.Join(dir, PageAppError+`.html`), []byte(`{{.Missing}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := Pages
+	Pages = NewPageTemplates(dir)
+	defer func() { Pages = old }()
+
+	r, _ := http.NewRequest(`GET`, `/`, nil)
+	r.Header.Set(`Accept`, `text/html`)
+	ctx := &engineContext{request: r, header: http.Header{}}
+	renderPage(ctx, ErrorInfo{Title: "Application Error", Type: ErrorTypeApp, StatusCode: 500, Message: "panic: oops", text: "panic: oops"})
+	if ctx.status != 500 || !strings.Contains(string(ctx.body), `panic: oops`) || !strings.Contains(string(ctx.body), `class="theme-`) {
+		t.Fatalf("expected the default page, got %d %s", ctx.status, ctx.body)
+	}
+}
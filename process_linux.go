@@ -0,0 +1,8 @@
+package main
+
+import "syscall"
+
+// setParentDeathSignal Tower被SIGKILL等无法处理的方式结束时，由内核结束程序，避免留下孤儿进程
+func setParentDeathSignal(attr *syscall.SysProcAttr) {
+	attr.Pdeathsig = syscall.SIGKILL
+}
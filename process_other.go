@@ -0,0 +1,8 @@
+//go:build !linux && !windows
+
+package main
+
+import "syscall"
+
+// setParentDeathSignal 只有Linux支持Pdeathsig
+func setParentDeathSignal(attr *syscall.SysProcAttr) {}
@@ -0,0 +1,72 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// setProcessGroup 让程序在自己的进程组中运行，停止时可以连同它启动的子进程一起结束
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	setParentDeathSignal(cmd.SysProcAttr)
+}
+
+// killProcessGroup 结束程序所在进程组中的所有进程
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	if err == syscall.ESRCH {
+		return cmd.Process.Kill()
+	}
+	return err
+}
+
+// 程序退出后最多回收其进程组中孤儿进程的时间
+const reapTimeout = 10 * time.Second
+
+// reapProcessGroup 在程序退出后回收进程组中已成为Tower子进程的孤儿进程，避免产生僵尸进程。
+// 只有Tower作为PID 1运行时孤儿进程才会成为Tower的子进程。使用WNOHANG并限制时间，
+// 以免阻塞，或者在进程组ID被重新使用后回收了无关的子进程
+func reapProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil || os.Getpid() != 1 {
+		return
+	}
+	var status syscall.WaitStatus
+	deadline := time.Now().Add(reapTimeout)
+	for time.Now().Before(deadline) {
+		pid, err := syscall.Wait4(-cmd.Process.Pid, &status, syscall.WNOHANG, nil)
+		switch {
+		case err == syscall.EINTR || pid > 0:
+			continue
+		case err != nil:
+			return //ECHILD：进程组中已没有Tower的子进程
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// signalProcessGroup 向程序所在进程组中的所有进程发送信号
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
+
+// towerSignals Tower自身处理的信号
+var towerSignals = map[os.Signal]int{
+	os.Interrupt:    signalExit,
+	syscall.SIGTERM: signalExit,
+	syscall.SIGHUP:  signalReload,
+	syscall.SIGUSR1: signalRebuild,
+	syscall.SIGUSR2: signalRestart,
+}
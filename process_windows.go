@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// setProcessGroup 让程序在自己的进程组中运行，停止时可以连同它启动的子进程一起结束
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// killProcessGroup 结束程序及其所有子进程
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	err := exec.Command(`taskkill`, `/T`, `/F`, `/PID`, strconv.Itoa(cmd.Process.Pid)).Run()
+	if err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
+
+// reapProcessGroup Windows上不会产生僵尸进程
+func reapProcessGroup(cmd *exec.Cmd) {}
+
+var errSignalUnsupported = errors.New("== Sending signals is not supported on windows")
+
+// signalProcessGroup Windows不支持向其它进程发送信号，调用者会直接结束程序
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	return errSignalUnsupported
+}
+
+// towerSignals Tower自身处理的信号
+var towerSignals = map[os.Signal]int{
+	os.Interrupt:    signalExit,
+	syscall.SIGTERM: signalExit,
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"errors"
 	"fmt"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -11,7 +13,13 @@ import (
 	"github.com/webx-top/reverseproxy"
 )
 
-const ProxyPort = "8080"
+const (
+	ProxyPort = "8080"
+
+	// 无法追踪请求开始时间时，认为在此时间内出现的异常属于当前请求
+	requestErrorWindow = 5 * time.Second
+	requestMaxTracked  = 1000
+)
 
 var errAppQuit = errors.New("== App quit unexpetedly")
 
@@ -23,44 +31,163 @@ type Proxy struct {
 	FirstRequest        *sync.Once
 	upgraded            int64
 	Port                string
-	AdminPwd            string
-	AdminIPs            []string
 	Engine              string
 	AutoRestartMaxTimes int
-	autoRestartTimes    int
-	waiting             bool
+	Queue               *BackendQueue
+	Gateway             *Gateway
+	TLS                 *Certificates    //为nil时不使用HTTPS
+	RedirectPort        string           //在此端口上把HTTP请求重定向到HTTPS
+	HTTP2               bool             //HTTPS时是否支持HTTP/2
+	H2C                 bool             //HTTP时是否支持h2c(不加密的HTTP/2)
+	Recorder            *RequestRecorder //为nil时不记录出错的请求
+	Maintenance         *Maintenance
+	requests            map[interface{}]*trackedRequest
+	requestMu           sync.Mutex
+}
+
+// trackedRequest 正在处理中的请求
+type trackedRequest struct {
+	start    time.Time
+	captured *CapturedRequest
 }
 
 func NewProxy(app *App, watcher *Watcher) (proxy Proxy) {
 	proxy.App = app
 	proxy.Watcher = watcher
 	proxy.Port = ProxyPort
-	proxy.AdminIPs = []string{`127.0.0.1`, `::1`}
 	proxy.AutoRestartMaxTimes = 3
+	proxy.Queue = NewBackendQueue(DefaultQueueSize, DefaultQueueTimeout)
+	proxy.Gateway = NewGateway(app)
+	proxy.requests = make(map[interface{}]*trackedRequest)
 	return
 }
 
-func (this *Proxy) authAdmin(ctx reverseproxy.Context) bool {
-	pwd := ctx.QueryValue(`pwd`)
-	valid := false
-	if len(pwd) > 0 && pwd == this.AdminPwd {
-		valid = true
-	} else {
-		clientIP := ctx.RemoteAddr()
-		if p := strings.LastIndex(clientIP, `]:`); p > -1 {
-			clientIP = clientIP[0:p]
-			clientIP = strings.TrimPrefix(clientIP, `[`)
-		} else if p := strings.LastIndex(clientIP, `:`); p > -1 {
-			clientIP = clientIP[0:p]
-		}
-		for _, ip := range this.AdminIPs {
-			if ip == clientIP {
-				valid = true
-				break
+// requestKey 返回可以作为map键的请求上下文
+func requestKey(ctx Context) (interface{}, bool) {
+	t := reflect.TypeOf(ctx)
+	return ctx, t != nil && t.Comparable()
+}
+
+func (this *Proxy) beginRequest(ctx Context) {
+	key, ok := requestKey(ctx)
+	if !ok {
+		return
+	}
+	tracked := &trackedRequest{start: time.Now()}
+	if this.Recorder != nil {
+		tracked.captured = this.Recorder.Snapshot(ctx)
+	}
+	this.requestMu.Lock()
+	if len(this.requests) >= requestMaxTracked {
+		for k, t := range this.requests {
+			if tracked.start.Sub(t.start) > time.Minute {
+				delete(this.requests, k)
 			}
 		}
 	}
-	return valid
+	this.requests[key] = tracked
+	this.requestMu.Unlock()
+}
+
+func (this *Proxy) finishRequest(ctx Context) *trackedRequest {
+	key, ok := requestKey(ctx)
+	if ok {
+		this.requestMu.Lock()
+		tracked, ok := this.requests[key]
+		delete(this.requests, key)
+		this.requestMu.Unlock()
+		if ok {
+			return tracked
+		}
+	}
+	return &trackedRequest{start: time.Now().Add(-requestErrorWindow)}
+}
+
+// captureRequest 保存出错的请求以便重放
+func (this *Proxy) captureRequest(tracked *trackedRequest, statusCode int, errMessage string) {
+	if this.Recorder == nil || tracked.captured == nil {
+		return
+	}
+	tracked.captured.StatusCode = statusCode
+	tracked.captured.Error = errMessage
+	this.Recorder.Save(tracked.captured)
+}
+
+// ensureBackend 没有可用的后端程序时在后台重启，并让请求排队等待重启完成
+func (this *Proxy) ensureBackend() error {
+	app := this.App
+	if !this.Queue.Busy() {
+		if app.IsQuit() {
+			log.Warn(errAppQuit)
+			this.Queue.Run(this.autoRestart)
+		} else if !app.IsRunning() || this.Watcher.Changed {
+			this.Queue.Run(func() error {
+				this.Watcher.Reset()
+				return app.Restart()
+			})
+		}
+	}
+	return this.Queue.Wait()
+}
+
+// autoRestart 程序意外退出后自动重启，最多尝试AutoRestartMaxTimes次
+func (this *Proxy) autoRestart() (err error) {
+	err = errAppQuit
+	for i := 0; i < this.AutoRestartMaxTimes; i++ {
+		var port string
+		port, err = getPort()
+		if err == nil {
+			err = this.App.Start(true, port)
+		} else {
+			err = this.App.Restart()
+		}
+		if err == nil {
+			return
+		}
+		log.Error(err)
+	}
+	return
+}
+
+func (this *Proxy) authAdmin(ctx Context) bool {
+	pwd := ctx.QueryValue(`pwd`)
+	if len(pwd) > 0 && pwd == this.App.Settings().AdminPwd {
+		return true
+	}
+	return this.isAdminIP(ctx)
+}
+
+func (this *Proxy) isAdminIP(ctx Context) bool {
+	clientIP := ctx.RemoteAddr()
+	if p := strings.LastIndex(clientIP, `]:`); p > -1 {
+		clientIP = clientIP[0:p]
+		clientIP = strings.TrimPrefix(clientIP, `[`)
+	} else if p := strings.LastIndex(clientIP, `:`); p > -1 {
+		clientIP = clientIP[0:p]
+	}
+	for _, ip := range this.App.Settings().AdminIPs {
+		if ip == clientIP {
+			return true
+		}
+	}
+	return false
+}
+
+// Features 返回当前设置需要引擎支持的特性
+func (this *Proxy) Features() []string {
+	features := []string{}
+	if this.TLS != nil {
+		features = append(features, FeatureTLS)
+		if this.HTTP2 {
+			features = append(features, FeatureHTTP2)
+		}
+	} else if this.H2C {
+		features = append(features, FeatureH2C)
+	}
+	if this.App.IsGRPC() {
+		features = append(features, FeatureGRPC)
+	}
+	return features
 }
 
 func (this *Proxy) Listen() error {
@@ -70,108 +197,228 @@ func (this *Proxy) Listen() error {
 	}
 	this.FirstRequest = &sync.Once{}
 	router := &ProxyRouter{Proxy: this}
-	router.dst = "http://localhost:" + app.Port
-	engine := ``
-	if strings.ToLower(this.Engine) == `fast` {
+	this.Gateway.SetBackend(app.Port)
+	this.appOldPort = app.Port
+	if this.App.IsTCP() {
+		return this.listenTCP(router)
+	}
+	engine := strings.ToLower(this.Engine)
+	if err := ValidateEngine(engine, this.Features()...); err != nil {
+		return err
+	}
+	if len(this.RedirectPort) > 0 && this.TLS != nil {
+		go func() {
+			if err := RedirectToHTTPS(this.RedirectPort, this.Port); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+	log.Info("== Listening to " + app.BackendURL(app.Port))
+	if engine == EngineTower {
+		scheme := `http`
+		if this.TLS != nil {
+			scheme = `https`
+		}
+		log.Info(`== Server(` + engineName(engine) + `) Address: ` + scheme + `://localhost:` + this.Port)
+		return NewTowerEngine(this, router).Listen(`:`+this.Port, this.TLS)
+	}
+	// fast和native引擎也通过Gateway转发：除了重试，后端的h2c连接、Unix socket和
+	// 切换版本时保留WebSocket/SSE连接都由Gateway实现
+	gateway, err := this.Gateway.Listen()
+	if err != nil {
+		return err
+	}
+	defer this.Gateway.Close()
+	router.dst = gateway
+	if engine == EngineFast {
 		this.ReserveProxy = &reverseproxy.FastReverseProxy{PassingBrowsingURL: true}
-		engine = `FastHTTP`
 	} else {
 		this.ReserveProxy = &reverseproxy.NativeReverseProxy{PassingBrowsingURL: true}
-		engine = `Standard`
 	}
 
 	config := reverseproxy.ReverseProxyConfig{
 		Listen:          `:` + this.Port,
 		Router:          router,
-		RequestIDHeader: "X-Request-ID",
+		RequestIDHeader: requestIDHeader,
 		ResponseBefore: func(ctx reverseproxy.Context) bool {
-			switch ctx.RequestPath() {
-			case "/tower-proxy/watch/pause":
-				status := `done`
-				if !this.authAdmin(ctx) {
-					status = `Authentication failed`
-				} else {
-					this.Watcher.Paused = true
-				}
-				ctx.SetStatusCode(200)
-				ctx.SetBody([]byte(status))
-				return true
-
-			case "/tower-proxy/watch/begin":
-				status := `done`
-				if !this.authAdmin(ctx) {
-					status = `Authentication failed`
-				} else {
-					this.Watcher.Paused = false
-				}
-				ctx.SetStatusCode(200)
-				ctx.SetBody([]byte(status))
-				return true
-
-			case "/tower-proxy/watch":
-				status := `OK`
-				if this.Watcher.Paused {
-					status = `Pause`
-				}
-				ctx.SetStatusCode(200)
-				ctx.SetBody([]byte(`watch status: ` + status))
-				return true
-			}
-
-			this.App.LastError = ""
-			if this.upgraded > 0 {
-				timeout := time.Now().Unix() - this.upgraded
-				if timeout > 3600 {
-					this.upgraded = 0
-				}
-				ctx.SetHeader(`X-Server-Upgraded`, fmt.Sprintf("%v", timeout))
-			}
-			if this.App.IsQuit() {
-				if this.waiting {
-					log.Warn(errAppQuit)
-					RenderError(ctx, this.App, "App quit unexpetedly.")
-					return true
-				}
-				this.waiting = true
-				err := errAppQuit
-				for ; this.autoRestartTimes < this.AutoRestartMaxTimes; this.autoRestartTimes++ {
-					var port string
-					port, err = getPort()
-					if err == nil {
-						err = this.App.Start(true, port)
-					}
-					if err == nil {
-						log.Error(err)
-					} else {
-						this.autoRestartTimes = 0
-						break
-					}
-				}
-				this.waiting = false
-				if err != nil {
-					log.Warn(errAppQuit)
-					RenderError(ctx, this.App, "App quit unexpetedly.")
-					return true
-				}
-			}
-			return false
+			return this.responseBefore(ctx)
 		},
 		ResponseAfter: func(ctx reverseproxy.Context) bool {
-			if len(this.App.LastError) != 0 {
-				RenderAppError(ctx, this.App, this.App.LastError)
-				return true
-			}
-			return false
+			return this.responseAfter(ctx)
 		},
 	}
-	this.appOldPort = app.Port
 	addr, err := this.ReserveProxy.Initialize(config)
 	if err != nil {
 		return err
 	}
-	log.Info("== Listening to " + router.dst)
-	log.Info(`== Server(`+engine+`) Address:`, addr)
+	log.Info(`== Server(`+engineName(engine)+`) Address:`, addr)
 	this.ReserveProxy.Listen()
 	this.ReserveProxy.Stop()
 	return nil
 }
+
+// responseBefore 转发请求前执行。返回true时不再转发，直接响应ctx中设置的内容
+func (this *Proxy) responseBefore(ctx Context) bool {
+	switch ctx.RequestPath() {
+	case "/tower-proxy/watch/pause":
+		status := `done`
+		if !this.authAdmin(ctx) {
+			status = `Authentication failed`
+		} else {
+			this.Watcher.Paused = true
+		}
+		ctx.SetStatusCode(200)
+		ctx.SetBody([]byte(status))
+		return true
+
+	case "/tower-proxy/watch/begin":
+		status := `done`
+		if !this.authAdmin(ctx) {
+			status = `Authentication failed`
+		} else {
+			this.Watcher.Paused = false
+		}
+		ctx.SetStatusCode(200)
+		ctx.SetBody([]byte(status))
+		return true
+
+	case "/tower-proxy/requests":
+		ctx.SetStatusCode(200)
+		if !this.authAdmin(ctx) {
+			ctx.SetBody([]byte(`Authentication failed`))
+			return true
+		}
+		body, err := capturedRequestsBody(this.Recorder, ctx.QueryValue(`pwd`))
+		if err != nil {
+			ctx.SetBody([]byte(err.Error()))
+			return true
+		}
+		ctx.SetHeader(`Content-Type`, `text/html;charset=utf-8`)
+		ctx.SetBody(body)
+		return true
+
+	case "/tower-proxy/requests/replay":
+		ctx.SetStatusCode(200)
+		if !this.authAdmin(ctx) {
+			ctx.SetBody([]byte(`Authentication failed`))
+			return true
+		}
+		if this.Recorder == nil {
+			ctx.SetBody([]byte(errCaptureDisabled.Error()))
+			return true
+		}
+		id, _ := strconv.ParseInt(ctx.QueryValue(`id`), 10, 64)
+		req := this.Recorder.Get(id)
+		if req == nil {
+			ctx.SetStatusCode(404)
+			ctx.SetBody([]byte(`Request not found`))
+			return true
+		}
+		log.Info(`== Replay request #`, id, `: `, req.Method, ` `, req.URI)
+		body, err := replayResultBody(Replay(this.App, req))
+		if err != nil {
+			ctx.SetBody([]byte(err.Error()))
+			return true
+		}
+		ctx.SetHeader(`Content-Type`, `text/html;charset=utf-8`)
+		ctx.SetBody(body)
+		return true
+
+	case "/tower-proxy/maintenance/on", "/tower-proxy/maintenance/off", "/tower-proxy/maintenance/bypass":
+		status := `done`
+		if !this.authAdmin(ctx) {
+			status = `Authentication failed`
+		} else if this.Maintenance == nil {
+			status = `maintenance mode is not supported`
+		} else {
+			var err error
+			switch ctx.RequestPath() {
+			case "/tower-proxy/maintenance/on":
+				retryAfter, _ := strconv.Atoi(ctx.QueryValue(`retryAfter`))
+				err = this.Maintenance.Enable(ctx.QueryValue(`message`), retryAfter)
+			case "/tower-proxy/maintenance/off":
+				err = this.Maintenance.Disable()
+			default:
+				if !this.Maintenance.IsEnabled() {
+					status = `maintenance mode is off`
+				} else {
+					ctx.SetHeader(`Set-Cookie`, this.Maintenance.BypassCookie())
+				}
+			}
+			if err != nil {
+				status = err.Error()
+			}
+		}
+		ctx.SetStatusCode(200)
+		ctx.SetBody([]byte(status))
+		return true
+
+	case "/tower-proxy/maintenance":
+		status := `maintenance status: Off`
+		if this.Maintenance != nil {
+			status = this.Maintenance.Status()
+		}
+		ctx.SetStatusCode(200)
+		ctx.SetBody([]byte(status))
+		return true
+
+	case "/tower-proxy/watch":
+		status := `OK`
+		if this.Watcher.Paused {
+			status = `Pause`
+		}
+		ctx.SetStatusCode(200)
+		ctx.SetBody([]byte(`watch status: ` + status))
+		return true
+	}
+
+	if this.Maintenance != nil && this.Maintenance.IsEnabled() && !this.isAdminIP(ctx) && !this.Maintenance.Bypassed(ctx) {
+		RenderMaintenance(ctx, this.App, this.Maintenance)
+		return true
+	}
+	if err := this.ensureBackend(); err != nil {
+		log.Warn(err)
+		switch {
+		case !this.App.DisabledBuild && len(this.App.BuildError) > 0:
+			RenderBuildError(ctx, this.App, this.App.BuildError)
+		case err == errQueueFull || err == errQueueTimeout:
+			RenderUnavailable(ctx, this.App, strings.TrimPrefix(err.Error(), `== `)+`.`)
+		default:
+			RenderError(ctx, this.App, "App quit unexpetedly.")
+		}
+		return true
+	}
+	if !this.App.DisabledBuild && len(this.App.BuildError) > 0 {
+		RenderBuildError(ctx, this.App, this.App.BuildError)
+		return true
+	}
+	if this.upgraded > 0 {
+		timeout := time.Now().Unix() - this.upgraded
+		if timeout > 3600 {
+			this.upgraded = 0
+		}
+		ctx.SetHeader(`X-Server-Upgraded`, fmt.Sprintf("%v", timeout))
+	}
+	if this.tunnelStream(ctx) {
+		return true
+	}
+	this.beginRequest(ctx)
+	return false
+}
+
+// responseAfter 后端程序响应后执行。返回true时使用ctx中设置的内容替换后端的响应
+func (this *Proxy) responseAfter(ctx Context) bool {
+	tracked := this.finishRequest(ctx)
+	failure := this.Gateway.TakeFailure(requestHeader(ctx, requestIDHeader))
+	if failure == nil {
+		return false
+	}
+	this.App.Errors.Wait(captureIdleTimeout * 5)
+	if appErr := this.App.Errors.Claim(tracked.start, failure.Port, failure.Conn); appErr != nil {
+		this.captureRequest(tracked, 500, appErr.Message)
+		RenderAppError(ctx, this.App, appErr.Message)
+		return true
+	}
+	this.captureRequest(tracked, failure.StatusCode, failure.Error)
+	return false
+}
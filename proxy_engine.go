@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/admpub/log"
+	rlog "github.com/webx-top/reverseproxy/log"
+)
+
+const (
+	EngineStandard = "standard"
+	EngineFast     = "fast"
+	// EngineTower 基于net/http的内置引擎，直接通过Gateway转发请求，支持TLS
+	EngineTower = "tower"
+
+	requestIDHeader = "X-Request-ID"
+)
+
+// 引擎支持的特性
+const (
+	FeatureTLS   = "TLS"
+	FeatureHTTP2 = "HTTP/2"
+	FeatureH2C   = "h2c"
+)
+
+// engineFeatures 各引擎支持的特性。standard和fast引擎只支持HTTP/1.1
+var engineFeatures = map[string]map[string]bool{
+	EngineStandard: {},
+	EngineFast:     {},
+	EngineTower:    {FeatureTLS: true, FeatureHTTP2: true, FeatureH2C: true, FeatureGRPC: true},
+}
+
+// ValidateEngine 检查引擎是否支持features中的特性
+func ValidateEngine(engine string, features ...string) error {
+	if len(engine) == 0 {
+		engine = EngineStandard
+	}
+	supported, ok := engineFeatures[strings.ToLower(engine)]
+	if !ok {
+		return errors.New(`== Unsupported engine: ` + engine)
+	}
+	for _, feature := range features {
+		if !supported[feature] {
+			return errors.New(`== ` + feature + ` is not supported by the "` + engine + `" engine, please use the "` + EngineTower + `" engine`)
+		}
+	}
+	return nil
+}
+
+// TowerEngine 内置代理引擎
+type TowerEngine struct {
+	Proxy  *Proxy
+	Router *ProxyRouter
+	server *http.Server
+}
+
+func NewTowerEngine(proxy *Proxy, router *ProxyRouter) *TowerEngine {
+	return &TowerEngine{Proxy: proxy, Router: router}
+}
+
+// Listen 开始监听，certs不为nil时使用HTTPS
+func (this *TowerEngine) Listen(addr string, certs *Certificates) error {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	if certs != nil {
+		protocols.SetHTTP2(this.Proxy.HTTP2)
+	} else {
+		protocols.SetUnencryptedHTTP2(this.Proxy.H2C)
+	}
+	this.server = &http.Server{Addr: addr, Handler: this, Protocols: protocols}
+	if certs == nil {
+		return this.server.ListenAndServe()
+	}
+	this.server.TLSConfig = certs.TLSConfig()
+	return this.server.ListenAndServeTLS(``, ``)
+}
+
+func (this *TowerEngine) Stop() error {
+	if this.server == nil {
+		return nil
+	}
+	return this.server.Close()
+}
+
+func (this *TowerEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if len(r.Header.Get(requestIDHeader)) == 0 {
+		r.Header.Set(requestIDHeader, newRequestID())
+	}
+	ctx := &engineContext{request: r, header: http.Header{}}
+	if this.Proxy.responseBefore(ctx) {
+		ctx.writeTo(w)
+		return
+	}
+	reqData, err := this.Router.ChooseBackend(r.Host)
+	if err != nil {
+		log.Error(err)
+		ctx.SetStatusCode(http.StatusBadGateway)
+		ctx.SetBody([]byte(http.StatusText(http.StatusBadGateway)))
+		ctx.writeTo(w)
+		return
+	}
+	setForwardedHeaders(r)
+	resp := &engineResponse{ResponseWriter: w, ctx: ctx, header: http.Header{}}
+	this.Proxy.Gateway.Handler().ServeHTTP(resp, r)
+	if !resp.wroteHeader {
+		resp.WriteHeader(http.StatusOK)
+	}
+	status := resp.status
+	if this.Proxy.responseAfter(ctx) && resp.held {
+		status = ctx.writeTo(w)
+	} else {
+		resp.release()
+		resp.writeTrailer()
+	}
+	this.Router.EndRequest(reqData, false, func() *rlog.LogEntry {
+		return &rlog.LogEntry{
+			Method:        r.Method,
+			Path:          r.URL.Path,
+			StatusCode:    status,
+			TotalDuration: time.Since(start),
+			RequestID:     r.Header.Get(requestIDHeader),
+		}
+	})
+}
+
+// setForwardedHeaders 设置后端程序获取客户端信息所需的头信息
+func setForwardedHeaders(r *http.Request) {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err == nil {
+		if prior := r.Header.Get(`X-Forwarded-For`); len(prior) > 0 {
+			clientIP = prior + `, ` + clientIP
+		}
+		r.Header.Set(`X-Forwarded-For`, clientIP)
+	}
+	if len(r.Header.Get(`X-Forwarded-Host`)) == 0 {
+		r.Header.Set(`X-Forwarded-Host`, r.Host)
+	}
+	if r.TLS != nil {
+		r.Header.Set(`X-Forwarded-Proto`, `https`)
+	} else if len(r.Header.Get(`X-Forwarded-Proto`)) == 0 {
+		r.Header.Set(`X-Forwarded-Proto`, `http`)
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// engineContext 内置引擎的请求上下文
+type engineContext struct {
+	request *http.Request
+	header  http.Header
+	status  int
+	body    []byte
+}
+
+func (this *engineContext) SetHeader(key string, value string) {
+	this.header.Set(key, value)
+}
+
+func (this *engineContext) SetBody(body []byte) {
+	this.body = body
+}
+
+func (this *engineContext) SetStatusCode(code int) {
+	this.status = code
+}
+
+func (this *engineContext) RemoteAddr() string {
+	return this.request.RemoteAddr
+}
+
+func (this *engineContext) RequestPath() string {
+	return this.request.URL.Path
+}
+
+func (this *engineContext) QueryValue(key string) string {
+	return this.request.URL.Query().Get(key)
+}
+
+func (this *engineContext) Request() *http.Request {
+	return this.request
+}
+
+// writeTo 输出钩子函数设置的响应内容，返回状态码
+func (this *engineContext) writeTo(w http.ResponseWriter) int {
+	for key, values := range this.header {
+		w.Header()[key] = values
+	}
+	status := this.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write(this.body)
+	return status
+}
+
+// engineResponse 转发后端的响应。5xx响应会先缓存起来，
+// 以便responseAfter用错误页面替换；其它响应直接输出(支持SSE和WebSocket)
+type engineResponse struct {
+	http.ResponseWriter
+	ctx         *engineContext
+	header      http.Header
+	status      int
+	wroteHeader bool
+	held        bool
+	buf         bytes.Buffer
+}
+
+func (this *engineResponse) Header() http.Header {
+	return this.header
+}
+
+func (this *engineResponse) WriteHeader(code int) {
+	if this.wroteHeader {
+		return
+	}
+	this.wroteHeader = true
+	this.status = code
+	if code >= 500 {
+		this.held = true
+		return
+	}
+	this.writeHeader()
+}
+
+func (this *engineResponse) writeHeader() {
+	h := this.ResponseWriter.Header()
+	for key, values := range this.header {
+		h[key] = values
+	}
+	for key, values := range this.ctx.header {
+		h[key] = values
+	}
+	this.ResponseWriter.WriteHeader(this.status)
+}
+
+func (this *engineResponse) Write(p []byte) (int, error) {
+	if !this.wroteHeader {
+		this.WriteHeader(http.StatusOK)
+	}
+	if this.held {
+		return this.buf.Write(p)
+	}
+	return this.ResponseWriter.Write(p)
+}
+
+func (this *engineResponse) Flush() {
+	if this.held {
+		return
+	}
+	if f, ok := this.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (this *engineResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := this.ResponseWriter.(http.Hijacker); ok {
+		this.wroteHeader = true
+		this.status = http.StatusSwitchingProtocols
+		return hj.Hijack()
+	}
+	return nil, nil, errors.New(`== Hijack is not supported`)
+}
+
+// writeTrailer 输出后端响应的Trailer(例如gRPC的grpc-status)
+func (this *engineResponse) writeTrailer() {
+	if this.status == http.StatusSwitchingProtocols {
+		return
+	}
+	h := this.ResponseWriter.Header()
+	declared := map[string]bool{}
+	for _, keys := range this.header.Values(`Trailer`) {
+		for _, key := range strings.Split(keys, `,`) {
+			declared[http.CanonicalHeaderKey(strings.TrimSpace(key))] = true
+		}
+	}
+	for key, values := range this.header {
+		if declared[key] || strings.HasPrefix(key, http.TrailerPrefix) {
+			h[key] = values
+		}
+	}
+}
+
+// release 输出缓存的5xx响应
+func (this *engineResponse) release() {
+	if !this.held {
+		return
+	}
+	this.held = false
+	this.writeHeader()
+	this.ResponseWriter.Write(this.buf.Bytes())
+}
+
+// engineName 返回引擎的显示名称
+func engineName(engine string) string {
+	switch strings.ToLower(engine) {
+	case EngineFast:
+		return `FastHTTP`
+	case EngineTower:
+		return `Tower`
+	default:
+		return `Standard`
+	}
+}
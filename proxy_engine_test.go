@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestValidateEngine(t *testing.T) {
+	cases := []struct {
+		engine   string
+		features []string
+		ok       bool
+	}{
+		{``, nil, true},
+		{`standard`, nil, true},
+		{`Fast`, nil, true},
+		{`unknown`, nil, false},
+		{`standard`, []string{FeatureTLS}, false},
+		{`fast`, []string{FeatureH2C}, false},
+		{`tower`, []string{FeatureTLS, FeatureHTTP2}, true},
+		{`tower`, []string{FeatureH2C}, true},
+	}
+	for _, c := range cases {
+		err := ValidateEngine(c.engine, c.features...)
+		if (err == nil) != c.ok {
+			t.Errorf("ValidateEngine(%q, %v) = %v", c.engine, c.features, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"sync"
 	"time"
 
@@ -11,7 +12,7 @@ import (
 
 type ProxyRouter struct {
 	*Proxy
-	dst           string //目标网址
+	dst           string //目标网址(Gateway的地址)
 	resultHost    string //最终操作的主机
 	resultReqData *reverseproxy.RequestData
 	resultIsDead  bool
@@ -21,21 +22,15 @@ type ProxyRouter struct {
 func (r *ProxyRouter) ChooseBackend(host string) (*reverseproxy.RequestData, error) {
 	this := r.Proxy
 	app := this.App
-	var err error
-	if app.SwitchToNewPort {
+	err := this.ensureBackend()
+	if err == nil && app.SwitchToNewPort {
 		this.FirstRequest.Do(func() {
 			log.Info(`== Switch port: `, this.appOldPort, ` => `, app.Port)
 			app.SwitchToNewPort = false
 			this.upgraded = time.Now().Unix()
-			go this.App.Clean()
-			r.dst = "http://localhost:" + app.Port
-			log.Info("== Listening to " + r.dst)
-			this.FirstRequest = &sync.Once{}
-		})
-	} else if !app.IsRunning() || this.Watcher.Changed {
-		this.FirstRequest.Do(func() {
-			this.Watcher.Reset()
-			err = app.Restart()
+			go this.drainAndClean()
+			this.Gateway.SetBackend(app.Port)
+			log.Info("== Listening to " + app.BackendURL(app.Port))
 			this.FirstRequest = &sync.Once{}
 		})
 	}
@@ -55,8 +50,11 @@ func (r *ProxyRouter) EndRequest(reqData *reverseproxy.RequestData, isDead bool,
 	r.resultReqData = reqData
 	r.logEntry = fn()
 	r.resultIsDead = isDead
-	if !r.Proxy.App.DisabledLogRequest {
+	if !r.Proxy.App.Settings().DisabledLogRequest {
 		log.Infof("== Request: %7s %s => Completed %d in %vs", r.logEntry.Method, r.logEntry.Path, r.logEntry.StatusCode, r.logEntry.TotalDuration.Seconds())
 	}
+	if tried := r.Proxy.Gateway.TakeRetries(r.logEntry.RequestID); len(tried) > 1 {
+		log.Warnf("== Request: %7s %s => Retried %d times (backends: %s)", r.logEntry.Method, r.logEntry.Path, len(tried)-1, strings.Join(tried, ` => `))
+	}
 	return nil
 }
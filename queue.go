@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultQueueSize    = 1000
+	DefaultQueueTimeout = 60 * time.Second
+)
+
+var (
+	errQueueFull    = errors.New("== Too many requests waiting for the app to start")
+	errQueueTimeout = errors.New("== Timed out waiting for the app to start")
+)
+
+// BackendQueue 在重启或编译期间(没有可用的后端程序时)暂存请求，
+// 待新程序就绪后再继续转发。超过Size的请求和等待超过Timeout的请求会返回错误
+type BackendQueue struct {
+	Size    int
+	Timeout time.Duration
+	mu      sync.Mutex
+	busy    bool
+	ready   chan struct{} //重启完成时关闭
+	lastErr error
+	waiting int
+}
+
+func NewBackendQueue(size int, timeout time.Duration) *BackendQueue {
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	if timeout <= 0 {
+		timeout = DefaultQueueTimeout
+	}
+	return &BackendQueue{Size: size, Timeout: timeout}
+}
+
+// Busy 是否正在重启
+func (this *BackendQueue) Busy() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.busy
+}
+
+// Run 在后台执行重启。已经在重启时不会重复执行
+func (this *BackendQueue) Run(fn func() error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.busy {
+		return
+	}
+	this.busy = true
+	this.ready = make(chan struct{})
+	go func() {
+		err := fn()
+		this.mu.Lock()
+		this.busy = false
+		this.lastErr = err
+		close(this.ready)
+		this.mu.Unlock()
+	}()
+}
+
+// Wait 等待重启完成，返回重启的结果
+func (this *BackendQueue) Wait() error {
+	this.mu.Lock()
+	if !this.busy {
+		this.mu.Unlock()
+		return nil
+	}
+	if this.waiting >= this.Size {
+		this.mu.Unlock()
+		return errQueueFull
+	}
+	this.waiting++
+	ready := this.ready
+	this.mu.Unlock()
+
+	defer func() {
+		this.mu.Lock()
+		this.waiting--
+		this.mu.Unlock()
+	}()
+	timer := time.NewTimer(this.Timeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		this.mu.Lock()
+		defer this.mu.Unlock()
+		return this.lastErr
+	case <-timer.C:
+		return errQueueTimeout
+	}
+}
+
+// Waiting 返回正在排队的请求数量
+func (this *BackendQueue) Waiting() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.waiting
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackendQueue(t *testing.T) {
+	q := NewBackendQueue(1, time.Second)
+	if err := q.Wait(); err != nil {
+		t.Fatalf("idle queue should not block: %v", err)
+	}
+	release := make(chan struct{})
+	errRestart := errors.New("restart failed")
+	q.Run(func() error {
+		<-release
+		return errRestart
+	})
+	q.Run(func() error {
+		t.Error("should not run twice")
+		return nil
+	})
+	result := make(chan error)
+	go func() {
+		result <- q.Wait()
+	}()
+	for q.Waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := q.Wait(); err != errQueueFull {
+		t.Errorf("expected %v, got %v", errQueueFull, err)
+	}
+	close(release)
+	if err := <-result; err != errRestart {
+		t.Errorf("expected %v, got %v", errRestart, err)
+	}
+}
+
+func TestBackendQueueTimeout(t *testing.T) {
+	q := NewBackendQueue(10, 10*time.Millisecond)
+	release := make(chan struct{})
+	defer close(release)
+	q.Run(func() error {
+		<-release
+		return nil
+	})
+	if err := q.Wait(); err != errQueueTimeout {
+		t.Errorf("expected %v, got %v", errQueueTimeout, err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/admpub/log"
+	"github.com/webx-top/tower/config"
+)
+
+// 检查配置文件是否被修改的间隔
+const configCheckInterval = 2 * time.Second
+
+// reloadableSettings 修改后不需要重启Tower就能生效的设置
+var reloadableSettings = map[string]bool{
+	`app.params`:              true,
+	`app.args`:                true,
+	`app.env`:                 true,
+	`app.envFile`:             true,
+	`app.portEnv`:             true,
+	`app.workDir`:             true,
+	`app.stopSignal`:          true,
+	`app.stopTimeout`:         true,
+	`proxy.retries`:           true,
+	`proxy.retryTimeout`:      true,
+	`proxy.retryStatusCodes`:  true,
+	`proxy.idempotencyHeader`: true,
+	`proxy.streamGracePeriod`: true,
+	`admin.password`:          true,
+	`admin.ips`:               true,
+	`watch.fileExtension`:     true,
+	`watch.ignoredPath`:       true,
+	`logLevel`:                true,
+	`verbose`:                 true,
+	`logRequest`:              true,
+}
+
+// ConfigReloader 监控Tower的配置文件，修改后在运行时应用可以直接生效的设置
+type ConfigReloader struct {
+	File    string
+	Build   bool //是否为编译模式
+	App     *App
+	Proxy   *Proxy
+	initial *config.Config //Tower启动时的配置
+	current *config.Config //最近一次应用的配置
+	modTime time.Time
+	mu      sync.Mutex //Watch和SIGHUP都会调用Reload
+}
+
+// NewConfigReloader 重新读取一次配置文件作为比较的基准。
+// 不使用c.Conf，因为启动时会修改其中的部分设置(例如：app.buildDir)
+func NewConfigReloader(file string, build bool, app *App, proxy *Proxy) (*ConfigReloader, error) {
+	reloader := &ConfigReloader{File: file, Build: build, App: app, Proxy: proxy}
+	if fi, err := os.Stat(file); err == nil {
+		reloader.modTime = fi.ModTime()
+	}
+	initial, err := loadLayeredConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	reloader.initial = initial
+	reloader.current = initial
+	return reloader, nil
+}
+
+// Watch 定时检查配置文件，被修改后重新载入
+func (this *ConfigReloader) Watch() {
+	for {
+		time.Sleep(configCheckInterval)
+		fi, err := os.Stat(this.File)
+		if err != nil || fi.ModTime().Equal(this.modTime) {
+			continue
+		}
+		this.modTime = fi.ModTime()
+		if err := this.Reload(); err != nil {
+			log.Error(`== Invalid config file, keep using the old config: `, err)
+		}
+	}
+}
+
+// Reload 重新读取配置文件。新配置有错误时返回错误并继续使用旧配置；
+// 需要重启Tower才能生效的设置只报告而不应用
+func (this *ConfigReloader) Reload() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	conf, err := loadLayeredConfig(this.File)
+	if err != nil {
+		return err
+	}
+	if err = ValidateConfig(this.File, this.Build, conf); err != nil {
+		return err
+	}
+	var applied, restart []string
+	for _, key := range diffConfig(this.current, conf) {
+		if reloadableSettings[key] {
+			applied = append(applied, key)
+		}
+	}
+	for _, key := range diffConfig(this.initial, conf) {
+		if !reloadableSettings[key] {
+			restart = append(restart, key)
+		}
+	}
+	if len(applied) > 0 {
+		if err = applyConfig(conf, this.App, this.Proxy); err != nil {
+			return err
+		}
+		log.Info(`== Reload config file ` + this.File + `: ` + strings.Join(applied, `, `))
+	}
+	if len(restart) > 0 {
+		log.Warn(`== Restart Tower to apply: ` + strings.Join(restart, `, `))
+	}
+	this.current = conf
+	return nil
+}
+
+// flattenConfig 把配置转换为“app.port”形式的键值对
+func flattenConfig(conf *config.Config) map[string]interface{} {
+	b, _ := json.Marshal(conf)
+	values := map[string]interface{}{}
+	json.Unmarshal(b, &values)
+	result := map[string]interface{}{}
+	for key, value := range values {
+		if section, ok := value.(map[string]interface{}); ok {
+			for name, v := range section {
+				result[key+`.`+name] = v
+			}
+			continue
+		}
+		result[key] = value
+	}
+	return result
+}
+
+// diffConfig 返回有变化的设置
+func diffConfig(old, new *config.Config) []string {
+	oldValues, newValues := flattenConfig(old), flattenConfig(new)
+	var changed []string
+	for key, value := range newValues {
+		if !reflect.DeepEqual(oldValues[key], value) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range oldValues {
+		if _, ok := newValues[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// applyConfig 把可以在运行时修改的设置应用到app和proxy，有错误时不做任何修改。
+// 设置作为一个整体替换，正在处理的请求和正在启动的程序使用的仍是替换前的设置
+func applyConfig(conf *config.Config, app *App, proxy *Proxy) error {
+	params, err := splitShellWords(*conf.App.RunParams)
+	if err != nil {
+		return err
+	}
+	env, err := LoadAppEnv(*conf.App.EnvFile, conf.App.Env)
+	if err != nil {
+		return err
+	}
+	stopSignal, err := ParseSignal(*conf.App.StopSignal)
+	if err != nil {
+		return err
+	}
+	if _, _, err = compileWatchPatterns(*conf.Watch.FileExtension, *conf.Watch.IgnoredPath); err != nil {
+		return err
+	}
+	logLevel := *conf.LogLevel
+	if *conf.Verbose {
+		logLevel = `Debug`
+	}
+	log.DefaultLog.SetLevel(logLevel)
+
+	// 为空时与以前的版本一样使用默认的127.0.0.1和::1。重新载入时也是如此，不会保留修改前的列表
+	var adminIPs []string
+	for _, ip := range strings.Split(*conf.Admin.IPs, `,`) {
+		if ip = strings.TrimSpace(ip); len(ip) > 0 {
+			adminIPs = append(adminIPs, ip)
+		}
+	}
+	if len(adminIPs) == 0 {
+		adminIPs = NewSettings().AdminIPs
+	}
+	app.UseSettings(&Settings{
+		RunParams:          append(params, conf.App.Args...),
+		Env:                env,
+		PortEnv:            *conf.App.PortEnv,
+		WorkDir:            *conf.App.WorkDir,
+		StopSignal:         stopSignal,
+		StopTimeout:        time.Duration(*conf.App.StopTimeout) * time.Second,
+		DisabledLogRequest: *conf.LogRequest == false,
+		Retries:            *conf.Proxy.Retries,
+		TryTimeout:         time.Duration(*conf.Proxy.RetryTimeout) * time.Second,
+		RetryStatusCodes:   ParseRetryStatusCodes(*conf.Proxy.RetryStatusCodes),
+		IdempotencyHeader:  *conf.Proxy.IdempotencyHeader,
+		StreamGracePeriod:  time.Duration(*conf.Proxy.StreamGracePeriod) * time.Second,
+		AdminPwd:           *conf.Admin.Password,
+		AdminIPs:           adminIPs,
+	})
+	if proxy.Watcher != nil {
+		return proxy.Watcher.SetPatterns(*conf.Watch.FileExtension, *conf.Watch.IgnoredPath)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/webx-top/tower/config"
+)
+
+func TestDiffConfig(t *testing.T) {
+	old := &config.Config{}
+	old.Fixed()
+	conf := &config.Config{}
+	conf.Fixed()
+	*conf.App.RunParams = `-c app.yaml`
+	*conf.Proxy.Port = `9090`
+	conf.App.Env = map[string]string{`A`: `1`}
+	changed := diffConfig(old, conf)
+	if expected := []string{`app.env`, `app.params`, `proxy.port`}; !reflect.DeepEqual(changed, expected) {
+		t.Fatalf("unexpected changes: %v", changed)
+	}
+	if !reloadableSettings[`app.params`] || reloadableSettings[`proxy.port`] {
+		t.Fatal("proxy.port should need a restart")
+	}
+}
+
+func TestApplyConfigKeepsOldOnError(t *testing.T) {
+	app := &App{}
+	app.UseSettings(&Settings{RunParams: []string{`old`}})
+	proxy := NewProxy(app, nil)
+	conf := &config.Config{}
+	conf.Fixed()
+	*conf.App.RunParams = `new`
+	*conf.Watch.IgnoredPath = `(`
+	if err := applyConfig(conf, app, &proxy); err == nil {
+		t.Fatal("expected an invalid regexp error")
+	}
+	if params := app.Settings().RunParams; !reflect.DeepEqual(params, []string{`old`}) {
+		t.Fatalf("run params should not change: %v", params)
+	}
+	*conf.Watch.IgnoredPath = ``
+	if err := applyConfig(conf, app, &proxy); err != nil {
+		t.Fatal(err)
+	}
+	if params := app.Settings().RunParams; !reflect.DeepEqual(params, []string{`new`}) {
+		t.Fatalf("unexpected run params: %v", params)
+	}
+}
+
+func TestApplyConfigAdminIPs(t *testing.T) {
+	app := &App{}
+	proxy := NewProxy(app, nil)
+	conf := &config.Config{}
+	conf.Fixed()
+	*conf.Admin.IPs = `10.0.0.1, 10.0.0.2`
+	if err := applyConfig(conf, app, &proxy); err != nil {
+		t.Fatal(err)
+	}
+	if ips := app.Settings().AdminIPs; !reflect.DeepEqual(ips, []string{`10.0.0.1`, `10.0.0.2`}) {
+		t.Fatalf("unexpected admin ips: %v", ips)
+	}
+	// 清空admin.ips后恢复为默认值，而不是保留修改前的列表
+	*conf.Admin.IPs = ``
+	if err := applyConfig(conf, app, &proxy); err != nil {
+		t.Fatal(err)
+	}
+	if ips := app.Settings().AdminIPs; !reflect.DeepEqual(ips, []string{`127.0.0.1`, `::1`}) {
+		t.Fatalf("admin ips should be reset to the default: %v", ips)
+	}
+}
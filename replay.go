@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCaptureMaxBodySize = 64 * 1024
+	DefaultCaptureMaxRequests = 20
+	replayTimeout             = 30 * time.Second
+	replayMaxResponseSize     = 64 * 1024
+)
+
+// 转发时不应该复制的头信息
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// CapturedRequest 出错(5xx或panic)的请求
+type CapturedRequest struct {
+	ID         int64
+	Time       time.Time
+	Method     string
+	URI        string
+	Host       string
+	Header     http.Header
+	Body       []byte
+	Truncated  bool //Body是否因超出大小限制而被截断
+	StatusCode int
+	Error      string
+}
+
+// RequestRecorder 保存最近出错的请求，以便在修复后重放
+type RequestRecorder struct {
+	MaxBodySize int64
+	MaxRequests int
+	mu          sync.Mutex
+	requests    []*CapturedRequest
+	lastID      int64
+}
+
+func NewRequestRecorder(maxBodySize int64, maxRequests int) *RequestRecorder {
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultCaptureMaxBodySize
+	}
+	if maxRequests <= 0 {
+		maxRequests = DefaultCaptureMaxRequests
+	}
+	return &RequestRecorder{
+		MaxBodySize: maxBodySize,
+		MaxRequests: maxRequests,
+		requests:    []*CapturedRequest{},
+	}
+}
+
+// Snapshot 在转发之前记录请求内容。此时尚不知道请求是否会出错
+func (this *RequestRecorder) Snapshot(ctx Context) *CapturedRequest {
+	req := &CapturedRequest{
+		Time:   time.Now(),
+		Method: requestMethod(ctx),
+		URI:    requestURI(ctx),
+		Host:   requestHost(ctx),
+		Header: http.Header{},
+	}
+	if len(req.Method) == 0 {
+		req.Method = `GET`
+	}
+	for k, v := range requestHeaders(ctx) {
+		req.Header[k] = append([]string{}, v...)
+	}
+	if req.Method != `GET` && req.Method != `HEAD` {
+		req.Body, req.Truncated = requestBody(ctx, this.MaxBodySize)
+	}
+	return req
+}
+
+// Save 保存出错的请求
+func (this *RequestRecorder) Save(req *CapturedRequest) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.lastID++
+	req.ID = this.lastID
+	this.requests = append(this.requests, req)
+	if len(this.requests) > this.MaxRequests {
+		this.requests = this.requests[len(this.requests)-this.MaxRequests:]
+	}
+}
+
+// List 按时间倒序列出保存的请求
+func (this *RequestRecorder) List() []*CapturedRequest {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	list := make([]*CapturedRequest, len(this.requests))
+	for i, req := range this.requests {
+		list[len(list)-1-i] = req
+	}
+	return list
+}
+
+func (this *RequestRecorder) Get(id int64) *CapturedRequest {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, req := range this.requests {
+		if req.ID == id {
+			return req
+		}
+	}
+	return nil
+}
+
+// ReplayResult 重放结果
+type ReplayResult struct {
+	Request    *CapturedRequest
+	Backend    string
+	StatusCode int
+	Header     http.Header
+	Body       string
+	Duration   time.Duration
+	Error      string
+	AppError   *AppError //重放过程中应用程序抛出的异常
+}
+
+func (this *ReplayResult) Fixed() bool {
+	return len(this.Error) == 0 && this.AppError == nil && this.StatusCode < 500
+}
+
+// Replay 将请求重新发送到当前正在运行的应用程序
+func Replay(app *App, req *CapturedRequest) *ReplayResult {
+	port := app.Port
+	result := &ReplayResult{Request: req, Backend: app.BackendURL(port)}
+	if req.Truncated {
+		result.Error = "request body was truncated when captured, cannot replay"
+		return result
+	}
+	r, err := http.NewRequest(req.Method, "http://"+app.BackendHost(port)+req.URI, bytes.NewReader(req.Body))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	for _, k := range hopHeaders {
+		r.Header.Del(k)
+	}
+	r.Host = req.Host
+	r.Header.Set(`X-Tower-Replay`, `1`)
+
+	var conn string
+	r = traceBackendConn(r, &conn)
+
+	start := time.Now()
+	client := &http.Client{
+		Timeout:   replayTimeout,
+		Transport: &http.Transport{DialContext: app.DialBackend},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(r)
+	result.Duration = time.Since(start)
+	if err == nil {
+		defer resp.Body.Close()
+		result.StatusCode = resp.StatusCode
+		result.Header = resp.Header
+		var body []byte
+		body, err = ioutil.ReadAll(io.LimitReader(resp.Body, replayMaxResponseSize))
+		result.Body = string(body)
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	if err != nil || result.StatusCode >= 500 {
+		app.Errors.Wait(captureIdleTimeout * 5)
+		result.AppError = app.Errors.Claim(start, port, conn)
+	}
+	return result
+}
+
+var errCaptureDisabled = errors.New("request capture is disabled")
+
+// capturedRequestsBody 生成管理页面中出错请求列表的内容
+func capturedRequestsBody(recorder *RequestRecorder, pwd string) ([]byte, error) {
+	if recorder == nil {
+		return nil, errCaptureDisabled
+	}
+	buf := new(bytes.Buffer)
+	err := requestsTemplate.Execute(buf, map[string]interface{}{
+		"Requests": recorder.List(),
+		"Pwd":      pwd,
+	})
+	return buf.Bytes(), err
+}
+
+func replayResultBody(result *ReplayResult) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := replayTemplate.Execute(buf, result)
+	return buf.Bytes(), err
+}
+
+func headerLines(h http.Header) string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := []string{}
+	for _, k := range keys {
+		for _, v := range h[k] {
+			lines = append(lines, k+": "+v)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
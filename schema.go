@@ -0,0 +1,8 @@
+package main
+
+import _ "embed"
+
+// configSchema YAML、TOML和JSON格式配置文件的JSON Schema(取值不区分大小写，所以只给出examples)
+//
+//go:embed tower.schema.json
+var configSchema string
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// Settings 可以在运行时通过重新载入配置文件修改的设置。
+// 程序、内部代理和管理接口在不同的goroutine中读取这些设置，所以修改时用App.UseSettings整体替换，
+// 不要修改已经使用的Settings
+type Settings struct {
+	RunParams          []string
+	Env                []string       //程序的环境变量(“KEY=VALUE”)，追加在Tower自身的环境变量之后
+	PortEnv            string         //通过环境变量传递端口，例如：“PORT”或“PORT,ADDR=127.0.0.1:{{port}}”
+	WorkDir            string         //程序的工作目录，为空时与Tower相同
+	StopSignal         syscall.Signal //停止程序时发送的信号
+	StopTimeout        time.Duration  //发送StopSignal后等待程序退出的时间，超时则强制结束
+	DisabledLogRequest bool
+
+	Retries           int           //最多重试次数
+	TryTimeout        time.Duration //每次尝试等待响应头的时间，为0时不限制
+	RetryStatusCodes  map[int]bool  //需要重试的响应状态码
+	IdempotencyHeader string        //带有此头信息的请求不论请求方式都可以重试
+	StreamGracePeriod time.Duration //切换版本后旧版本上的WebSocket/SSE连接最多保留的时间
+
+	AdminPwd string
+	AdminIPs []string
+}
+
+// NewSettings 返回默认设置
+func NewSettings() *Settings {
+	return &Settings{
+		RunParams:         []string{},
+		StopSignal:        syscall.SIGTERM,
+		StopTimeout:       DefaultStopTimeout,
+		Retries:           DefaultRetries,
+		RetryStatusCodes:  map[int]bool{},
+		IdempotencyHeader: DefaultIdempotencyHeader,
+		StreamGracePeriod: DefaultStreamGracePeriod,
+		AdminIPs:          []string{`127.0.0.1`, `::1`},
+	}
+}
+
+// Settings 返回当前的设置，没有设置时返回默认设置
+func (this *App) Settings() *Settings {
+	if settings := this.settings.Load(); settings != nil {
+		return settings
+	}
+	return NewSettings()
+}
+
+// UseSettings 用settings替换当前的设置
+func (this *App) UseSettings(settings *Settings) {
+	this.settings.Store(settings)
+}
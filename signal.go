@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/admpub/log"
+)
+
+const (
+	DefaultStopSignal  = "SIGTERM"
+	DefaultStopTimeout = 10 * time.Second
+)
+
+// Tower收到信号后的操作
+const (
+	signalExit = iota + 1
+	signalReload
+	signalRebuild
+	signalRestart
+)
+
+var stopSignals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGKILL": syscall.SIGKILL,
+}
+
+// ParseSignal 解析停止程序时发送的信号，例如：“SIGTERM”或“TERM”
+func ParseSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if len(name) == 0 {
+		name = DefaultStopSignal
+	}
+	if !strings.HasPrefix(name, `SIG`) {
+		name = `SIG` + name
+	}
+	sig, ok := stopSignals[name]
+	if !ok {
+		return 0, errors.New("== Unsupported stop signal: " + name)
+	}
+	return sig, nil
+}
+
+// stopCmd 向程序的进程组发送StopSignal，等待最多StopTimeout后结束整个进程组
+func (this *App) stopCmd(cmd *exec.Cmd) error {
+	settings := this.Settings()
+	if settings.StopSignal == 0 || settings.StopSignal == syscall.SIGKILL || settings.StopTimeout <= 0 {
+		return killProcessGroup(cmd)
+	}
+	if err := signalProcessGroup(cmd, settings.StopSignal); err != nil {
+		return killProcessGroup(cmd)
+	}
+	select {
+	case <-cmdDone(cmd):
+	case <-time.After(settings.StopTimeout):
+		log.Warn(`== The app did not exit within ` + settings.StopTimeout.String() + `, kill it`)
+		return killProcessGroup(cmd)
+	}
+	// 程序已退出，结束它留下的子进程
+	killProcessGroup(cmd)
+	return nil
+}
+
+// SignalHandler 处理Tower自身收到的信号，以便在systemd或Docker(作为PID 1)中运行：
+// SIGINT/SIGTERM停止所有程序后退出，SIGHUP重新载入配置文件，SIGUSR1强制重新编译，SIGUSR2重启程序
+type SignalHandler struct {
+	Exit    func()
+	Reload  func() error
+	Rebuild func() error
+	Restart func() error
+}
+
+func (this *SignalHandler) Listen() {
+	signals := make([]os.Signal, 0, len(towerSignals))
+	for sig := range towerSignals {
+		signals = append(signals, sig)
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	go func() {
+		for sig := range ch {
+			log.Info(`== Received signal: ` + sig.String())
+			var err error
+			switch towerSignals[sig] {
+			case signalExit:
+				this.Exit()
+				return
+			case signalReload:
+				err = this.Reload()
+			case signalRebuild:
+				err = this.Rebuild()
+			case signalRestart:
+				err = this.Restart()
+			}
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
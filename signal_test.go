@@ -0,0 +1,62 @@
+//go:build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseSignal(t *testing.T) {
+	for name, expected := range map[string]syscall.Signal{``: syscall.SIGTERM, `int`: syscall.SIGINT, `SIGQUIT`: syscall.SIGQUIT} {
+		sig, err := ParseSignal(name)
+		if err != nil || sig != expected {
+			t.Fatalf("%q: unexpected signal %v, %v", name, sig, err)
+		}
+	}
+	if _, err := ParseSignal(`SIGFOO`); err == nil {
+		t.Fatal("expected error for unknown signal")
+	}
+}
+
+func TestStopCmd(t *testing.T) {
+	app := &App{}
+	app.UseSettings(&Settings{StopSignal: syscall.SIGTERM, StopTimeout: 500 * time.Millisecond})
+	stopTimeout := app.Settings().StopTimeout
+	start := func(script string) *exec.Cmd {
+		cmd := exec.Command(`/bin/sh`, `-c`, script)
+		setProcessGroup(cmd)
+		trackCmd(cmd)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			cmd.Wait()
+			cmdExited(cmd)
+		}()
+		time.Sleep(100 * time.Millisecond)
+		return cmd
+	}
+
+	// 收到信号后退出
+	cmd := start(`sleep 30`)
+	begin := time.Now()
+	app.stopCmd(cmd)
+	if time.Since(begin) >= stopTimeout || CmdIsRunning(cmd) {
+		t.Fatal("app should exit on SIGTERM")
+	}
+
+	// 忽略信号，超时后强制结束
+	cmd = start(`trap "" TERM; sleep 30`)
+	begin = time.Now()
+	app.stopCmd(cmd)
+	if time.Since(begin) < stopTimeout {
+		t.Fatal("should wait for the stop timeout")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if CmdIsRunning(cmd) {
+		t.Fatal("app should be killed after the stop timeout")
+	}
+}
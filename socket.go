@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// socket激活模式下，新版本程序启动后等待此时间仍在运行即认为已就绪
+const socketReadyDelay = 1 * time.Second
+
+var errSocketActivationUnsupported = errors.New("== Socket activation is not supported on " + runtime.GOOS)
+
+// OpenActivationListener 由Tower监听address，返回用于传递给程序的文件
+func OpenActivationListener(address string) (*os.File, error) {
+	if runtime.GOOS == "windows" {
+		return nil, errSocketActivationUnsupported
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	return l.(*net.TCPListener).File()
+}
+
+// socketActivationCommand 按照systemd的LISTEN_FDS约定把监听socket作为文件描述符3传递给程序。
+// LISTEN_PID必须是程序自身的进程ID，所以通过sh设置后再exec
+func socketActivationCommand(listener *os.File, bin string, params ...string) *exec.Cmd {
+	args := append([]string{`-c`, `LISTEN_PID=$$ exec "$0" "$@"`, bin}, params...)
+	cmd := exec.Command(`/bin/sh`, args...)
+	cmd.ExtraFiles = []*os.File{listener}
+	cmd.Env = append(os.Environ(), `LISTEN_FDS=1`, `LISTEN_FDNAMES=tower`)
+	return cmd
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSocketActivationCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip(errSocketActivationUnsupported)
+	}
+	listener, err := OpenActivationListener(`127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	cmd := socketActivationCommand(listener, `/bin/sh`, `-c`, `test -e /dev/fd/3 && echo "$LISTEN_FDS $LISTEN_PID $$"`)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 3 || fields[0] != `1` || fields[1] != fields[2] {
+		t.Fatalf("LISTEN_FDS/LISTEN_PID not passed correctly: %q", out)
+	}
+}
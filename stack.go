@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	goroutineHeaderRegexp = regexp.MustCompile(`^goroutine (\d+) \[([^\]]*)\]:$`)
+	// \t/Users/user/tower/test/server1.go:16 +0x1a
+	// \tC:/Users/user/tower/test/server1.go:16
+	frameFileRegexp = regexp.MustCompile(`^\t(.+):(\d+)(?: \+(0x[0-9a-fA-F]+))?$`)
+	createdByRegexp = regexp.MustCompile(`^created by (.+?)(?: in goroutine \d+)?$`)
+	// Go 1.0: /Users/user/tower/test/server1.go:16 (0x211e)
+	legacyFileRegexp = regexp.MustCompile(`^(\S.*):(\d+) \((0x[0-9a-fA-F]+)\)$`)
+)
+
+const runtimeStackHeader = "runtime stack:"
+
+// Stack 解析后的panic或runtime/debug.Stack输出
+type Stack struct {
+	Message    []string
+	Goroutines []*Goroutine
+}
+
+type Goroutine struct {
+	ID     int
+	State  string
+	Frames []*Frame
+}
+
+type Frame struct {
+	Func      string
+	Args      string
+	File      string
+	Line      int
+	Offset    string
+	CreatedBy bool
+	AppFile   bool
+	Stdlib    bool
+	Vendor    bool
+}
+
+// Package 返回函数所在的包路径。例如：github.com/a/b.(*T).M => github.com/a/b
+func (this *Frame) Package() string {
+	name := this.Func
+	if strings.ContainsAny(name, " \t") {
+		return ""
+	}
+	slash := strings.LastIndex(name, "/")
+	dot := strings.Index(name[slash+1:], ".")
+	if dot < 0 {
+		return name
+	}
+	return name[:slash+1+dot]
+}
+
+// ParseStack 解析Go 1.0以来的各种panic和stack输出格式
+func ParseStack(s string) *Stack {
+	stack := &Stack{}
+	var (
+		g       *Goroutine
+		last    *Frame
+		legacy  bool
+		scanner = bufio.NewScanner(strings.NewReader(s))
+	)
+	scanner.Buffer(make([]byte, 0, 64*1024), captureMaxSize)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if matches := goroutineHeaderRegexp.FindStringSubmatch(line); matches != nil {
+			id, _ := strconv.Atoi(matches[1])
+			g = &Goroutine{ID: id, State: matches[2]}
+			stack.Goroutines = append(stack.Goroutines, g)
+			last = nil
+			continue
+		}
+		if line == runtimeStackHeader {
+			// fatal error的输出中，系统栈位于goroutine之前
+			g = &Goroutine{State: strings.TrimSuffix(line, ":")}
+			stack.Goroutines = append(stack.Goroutines, g)
+			last = nil
+			continue
+		}
+		if matches := legacyFileRegexp.FindStringSubmatch(line); matches != nil {
+			if g == nil {
+				g = &Goroutine{}
+				stack.Goroutines = append(stack.Goroutines, g)
+			}
+			last = &Frame{File: matches[1], Offset: matches[3]}
+			last.Line, _ = strconv.Atoi(matches[2])
+			g.Frames = append(g.Frames, last)
+			legacy = true
+			continue
+		}
+		if g == nil {
+			if len(strings.TrimSpace(line)) > 0 {
+				stack.Message = append(stack.Message, line)
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "\t") {
+			if last == nil {
+				continue
+			}
+			if legacy && len(last.Func) == 0 {
+				// \tPanic: panic(errors.New("Panic !!"))
+				last.Func = strings.TrimSpace(line)
+				continue
+			}
+			if matches := frameFileRegexp.FindStringSubmatch(line); matches != nil && len(last.File) == 0 {
+				last.File = matches[1]
+				last.Line, _ = strconv.Atoi(matches[2])
+				last.Offset = matches[3]
+			}
+			continue
+		}
+		if matches := createdByRegexp.FindStringSubmatch(line); matches != nil {
+			last = &Frame{Func: matches[1], CreatedBy: true}
+			g.Frames = append(g.Frames, last)
+			continue
+		}
+		if fn, args, ok := splitFuncArgs(line); ok {
+			last = &Frame{Func: fn, Args: args}
+			g.Frames = append(g.Frames, last)
+			continue
+		}
+		// “...additional frames elided...”以及其它无法识别的行
+		last = nil
+	}
+	return stack
+}
+
+// splitFuncArgs 将“main.(*T).M(0x1, {0x2, 0x3})”拆分为函数名和参数
+func splitFuncArgs(line string) (fn string, args string, ok bool) {
+	if !strings.HasSuffix(line, ")") {
+		return
+	}
+	depth := 0
+	for i := len(line) - 1; i >= 0; i-- {
+		switch line[i] {
+		case ')':
+			depth++
+		case '(':
+			depth--
+			if depth == 0 {
+				fn = line[:i]
+				args = line[i+1 : len(line)-1]
+				ok = len(fn) > 0 && !strings.ContainsAny(fn, " \t")
+				return
+			}
+		}
+	}
+	return
+}
+
+// MarkFrames 标记属于当前项目、标准库和第三方库的帧
+func (this *Stack) MarkFrames(mod *GoModule) {
+	goroot := filepath.ToSlash(runtime.GOROOT())
+	wd, _ := os.Getwd()
+	wd = filepath.ToSlash(wd)
+	for _, g := range this.Goroutines {
+		for _, f := range g.Frames {
+			file := filepath.ToSlash(f.File)
+			pkg := f.Package()
+			f.Vendor = strings.Contains(file, "/vendor/") || strings.Contains(file, "/pkg/mod/")
+			// 模块路径可以不含“.”(例如“module myapp”)，所以先判断是否属于当前项目
+			if !f.Vendor && mod != nil && (mod.Contains(file) || mod.OwnsPackage(pkg)) {
+				f.AppFile = true
+				continue
+			}
+			f.Stdlib = !f.Vendor && ((len(goroot) > 0 && strings.HasPrefix(file, goroot+"/")) ||
+				(len(pkg) > 0 && pkg != "main" && !strings.Contains(strings.SplitN(pkg, "/", 2)[0], ".")))
+			if f.Vendor || f.Stdlib || len(file) == 0 {
+				continue
+			}
+			if mod == nil && len(wd) > 0 {
+				f.AppFile = strings.HasPrefix(file, wd+"/")
+			}
+		}
+	}
+}
+
+// Current 返回引发异常的goroutine(跳过fatal error中的系统栈)
+func (this *Stack) Current() *Goroutine {
+	for _, g := range this.Goroutines {
+		if g.State != strings.TrimSuffix(runtimeStackHeader, ":") {
+			return g
+		}
+	}
+	if len(this.Goroutines) > 0 {
+		return this.Goroutines[0]
+	}
+	return nil
+}
+
+// GoModule go.mod中声明的模块
+type GoModule struct {
+	Path string //模块路径
+	Dir  string //go.mod所在文件夹
+}
+
+var (
+	goModules   = map[string]*GoModule{}
+	goModulesMu sync.Mutex
+)
+
+// FindGoModule 从dir开始逐级向上查找go.mod
+func FindGoModule(dir string) *GoModule {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil
+	}
+	goModulesMu.Lock()
+	defer goModulesMu.Unlock()
+	if mod, ok := goModules[dir]; ok {
+		return mod
+	}
+	var mod *GoModule
+	for d := dir; ; {
+		if path := readModulePath(filepath.Join(d, "go.mod")); len(path) > 0 {
+			mod = &GoModule{Path: path, Dir: filepath.ToSlash(d)}
+			break
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			break
+		}
+		d = parent
+	}
+	goModules[dir] = mod
+	return mod
+}
+
+func readModulePath(goMod string) string {
+	f, err := os.Open(goMod)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "module") {
+			path := strings.TrimSpace(strings.TrimPrefix(line, "module"))
+			return strings.Trim(path, `"`)
+		}
+	}
+	return ""
+}
+
+// Contains 文件是否位于模块内(不含vendor)
+func (this *GoModule) Contains(file string) bool {
+	file = filepath.ToSlash(file)
+	return strings.HasPrefix(file, this.Dir+"/") && !strings.HasPrefix(file, this.Dir+"/vendor/")
+}
+
+// OwnsPackage 包是否属于本模块(用于-trimpath编译的程序)
+func (this *GoModule) OwnsPackage(pkg string) bool {
+	return pkg == this.Path || strings.HasPrefix(pkg, this.Path+"/")
+}
+
+// Rel 返回相对于模块根目录的路径
+func (this *GoModule) Rel(file string) string {
+	file = filepath.ToSlash(file)
+	if this.Contains(file) {
+		return strings.TrimPrefix(file, this.Dir+"/")
+	}
+	if strings.HasPrefix(file, this.Path+"/") {
+		return strings.TrimPrefix(file, this.Path+"/")
+	}
+	return file
+}
+
+// Abs 返回文件的绝对路径。-trimpath编译的程序中文件路径以模块路径开头
+func (this *GoModule) Abs(file string) string {
+	file = filepath.ToSlash(file)
+	if !this.Contains(file) && strings.HasPrefix(file, this.Path+"/") {
+		file = this.Dir + "/" + strings.TrimPrefix(file, this.Path+"/")
+	}
+	return filepath.FromSlash(file)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+)
+
+const modernStack = `2013/02/12 18:24:15 http: panic serving 127.0.0.1:54114: Panic !!
+goroutine 5 [running]:
+net/http.(*conn).serve.func1()
+	/usr/local/go/src/net/http/server.go:1898 +0xbe
+panic({0x6c8f00?, 0xc00009e000?})
+	/usr/local/go/src/runtime/panic.go:770 +0x132
+main.(*Server).Panic(...)
+	/home/user/app/server.go:36
+github.com/user/app/handler.Do({0x7f1c58?, 0xc0000ba000?}, 0x0?)
+	/home/user/app/handler/do.go:12 +0x45
+github.com/lib/pq.(*conn).query(0xc0000ba000)
+	/home/user/go/pkg/mod/github.com/lib/pq@v1.10.9/conn.go:100 +0x20
+created by net/http.(*Server).Serve in goroutine 1
+	/usr/local/go/src/net/http/server.go:3285 +0x4b4
+
+goroutine 1 [IO wait]:
+internal/poll.runtime_pollWait(0x7f, 0x72)
+	/usr/local/go/src/runtime/netpoll.go:345 +0x85
+`
+
+func TestParseStack(t *testing.T) {
+	stack := ParseStack(modernStack)
+	if len(stack.Message) != 1 || stack.Message[0] != "2013/02/12 18:24:15 http: panic serving 127.0.0.1:54114: Panic !!" {
+		t.Fatalf("unexpected message: %q", stack.Message)
+	}
+	if len(stack.Goroutines) != 2 {
+		t.Fatalf("expected 2 goroutines, got %d", len(stack.Goroutines))
+	}
+	g := stack.Goroutines[0]
+	if g.ID != 5 || g.State != "running" || len(g.Frames) != 6 {
+		t.Fatalf("unexpected goroutine: %+v", g)
+	}
+	f := g.Frames[3]
+	if f.Func != "github.com/user/app/handler.Do" || f.Args != "{0x7f1c58?, 0xc0000ba000?}, 0x0?" {
+		t.Errorf("unexpected function: %q %q", f.Func, f.Args)
+	}
+	if f.File != "/home/user/app/handler/do.go" || f.Line != 12 || f.Offset != "0x45" {
+		t.Errorf("unexpected location: %s:%d %s", f.File, f.Line, f.Offset)
+	}
+	if inlined := g.Frames[2]; inlined.Args != "..." || inlined.Line != 36 || len(inlined.Offset) != 0 {
+		t.Errorf("unexpected inlined frame: %+v", inlined)
+	}
+	if created := g.Frames[5]; !created.CreatedBy || created.Func != "net/http.(*Server).Serve" {
+		t.Errorf("unexpected created by frame: %+v", created)
+	}
+}
+
+func TestMarkFrames(t *testing.T) {
+	stack := ParseStack(modernStack)
+	stack.MarkFrames(&GoModule{Path: "github.com/user/app", Dir: "/home/user/app"})
+	frames := stack.Current().Frames
+	expected := []struct{ app, stdlib, vendor bool }{
+		{false, true, false},
+		{false, true, false},
+		{true, false, false},
+		{true, false, false},
+		{false, false, true},
+		{false, true, false},
+	}
+	for i, e := range expected {
+		f := frames[i]
+		if f.AppFile != e.app || f.Stdlib != e.stdlib || f.Vendor != e.vendor {
+			t.Errorf("frame %d (%s): got app=%v stdlib=%v vendor=%v", i, f.Func, f.AppFile, f.Stdlib, f.Vendor)
+		}
+	}
+}
+
+func TestMarkFramesDotlessModule(t *testing.T) {
+	stack := ParseStack(`panic: oops
+
+goroutine 1 [running]:
+myapp/handlers.Index(...)
+	/home/user/myapp/handlers/index.go:12 +0x1a
+myapp/models.Load()
+	myapp/models/load.go:8 +0x2b
+net/http.HandlerFunc.ServeHTTP(0x0, {0x0, 0x0}, 0x0)
+	/usr/local/go/src/net/http/server.go:2136 +0x29
+`)
+	stack.MarkFrames(&GoModule{Path: "myapp", Dir: "/home/user/myapp"})
+	frames := stack.Current().Frames
+	expected := []struct{ app, stdlib bool }{
+		{true, false},
+		{true, false},
+		{false, true},
+	}
+	for i, e := range expected {
+		f := frames[i]
+		if f.AppFile != e.app || f.Stdlib != e.stdlib {
+			t.Errorf("frame %d (%s): got app=%v stdlib=%v", i, f.Func, f.AppFile, f.Stdlib)
+		}
+	}
+}
+
+func TestParseStackWindowsPath(t *testing.T) {
+	stack := ParseStack("panic: oops\n\ngoroutine 1 [running]:\nmain.main()\n\tC:/Users/user/app/main.go:9 +0x1a\n")
+	f := stack.Current().Frames[0]
+	if f.File != "C:/Users/user/app/main.go" || f.Line != 9 {
+		t.Errorf("unexpected location: %s:%d", f.File, f.Line)
+	}
+	if stack.Message[0] != "panic: oops" {
+		t.Errorf("unexpected message: %q", stack.Message)
+	}
+}
+
+func TestParseLegacyStack(t *testing.T) {
+	stack := ParseStack(`2013/02/12 18:24:15 http: panic serving 127.0.0.1:54114: Panic !!
+/usr/local/Cellar/go/1.0.3/src/pkg/net/http/server.go:589 (0x31ed9)
+	_func_004: buf.Write(debug.Stack())
+/Users/user/tower/test/server1.go:16 (0x211e)
+	Panic: panic(errors.New("Panic !!"))
+`)
+	frames := stack.Current().Frames
+	if len(frames) != 2 {
+		t.Fatalf("expected 2 frames, got %d", len(frames))
+	}
+	if frames[1].File != "/Users/user/tower/test/server1.go" || frames[1].Line != 16 || frames[1].Func != `Panic: panic(errors.New("Panic !!"))` {
+		t.Errorf("unexpected frame: %+v", frames[1])
+	}
+}
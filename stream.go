@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/admpub/log"
+)
+
+// DefaultStreamGracePeriod 切换版本后，旧版本上的WebSocket/SSE连接最多保留的时间
+const DefaultStreamGracePeriod = 60 * time.Second
+
+var streamUnsupportedOnce sync.Once
+
+// isUpgradeRequest 是否为WebSocket等协议升级请求
+func isUpgradeRequest(ctx Context) bool {
+	return len(requestHeader(ctx, `Upgrade`)) > 0 &&
+		strings.Contains(strings.ToLower(requestHeader(ctx, `Connection`)), `upgrade`)
+}
+
+// isEventStreamRequest 是否为SSE请求
+func isEventStreamRequest(ctx Context) bool {
+	return strings.Contains(requestHeader(ctx, `Accept`), `text/event-stream`)
+}
+
+// contextHijacker 从代理引擎的Context中获取http.Hijacker，不支持时返回nil
+func contextHijacker(ctx Context) http.Hijacker {
+	switch v := ctx.(type) {
+	case http.Hijacker:
+		return v
+	case interface{ ResponseWriter() http.ResponseWriter }:
+		hj, _ := v.ResponseWriter().(http.Hijacker)
+		return hj
+	case interface{ ResponseWriter() io.Writer }:
+		hj, _ := v.ResponseWriter().(http.Hijacker)
+		return hj
+	}
+	return nil
+}
+
+// fastHijacker fasthttp引擎的Context接管连接的方式：在输出响应头之后调用handler
+type fastHijacker interface {
+	Hijack(handler func(net.Conn))
+}
+
+// tunnelStream 由Tower直接转发standard和fast引擎中的WebSocket和SSE请求，
+// 不依赖引擎本身对协议升级和流式响应的支持。返回false时交给引擎处理
+func (this *Proxy) tunnelStream(ctx Context) bool {
+	if _, ok := ctx.(*engineContext); ok {
+		// 内置引擎本身就支持
+		return false
+	}
+	upgrade := isUpgradeRequest(ctx)
+	if !upgrade && !isEventStreamRequest(ctx) {
+		return false
+	}
+	hijacker := contextHijacker(ctx)
+	fast, _ := ctx.(fastHijacker)
+	if hijacker == nil && (fast == nil || !upgrade) {
+		streamUnsupportedOnce.Do(func() {
+			log.Warn(`== The "` + this.Engine + `" engine can not take over WebSocket/SSE connections, please use the "` + EngineTower + `" engine`)
+		})
+		return false
+	}
+	req, err := streamRequest(ctx, upgrade)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	port := this.Gateway.Backend()
+	network, address := this.App.BackendAddress(port)
+	backend, err := net.DialTimeout(network, address, 5*time.Second)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	if err = req.Write(backend); err != nil {
+		backend.Close()
+		log.Error(err)
+		return false
+	}
+	br := bufio.NewReader(backend)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		backend.Close()
+		log.Error(err)
+		RenderError(ctx, this.App, err.Error())
+		return true
+	}
+	if upgrade && resp.StatusCode != http.StatusSwitchingProtocols {
+		// 后端拒绝升级，原样返回响应
+		defer backend.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, replayMaxResponseSize))
+		for key := range resp.Header {
+			ctx.SetHeader(key, resp.Header.Get(key))
+		}
+		ctx.SetStatusCode(resp.StatusCode)
+		ctx.SetBody(body)
+		return true
+	}
+	done := this.Gateway.TrackStream(port)
+	if hijacker == nil {
+		for key := range resp.Header {
+			ctx.SetHeader(key, resp.Header.Get(key))
+		}
+		ctx.SetStatusCode(resp.StatusCode)
+		fast.Hijack(func(conn net.Conn) {
+			defer done()
+			pipeConn(conn, nil, backend, br)
+		})
+		return true
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		done()
+		backend.Close()
+		log.Error(err)
+		return false
+	}
+	go func() {
+		defer done()
+		if !upgrade {
+			// SSE：去掉分块编码，以关闭连接作为响应结束
+			resp.Header.Del(`Transfer-Encoding`)
+			resp.Header.Del(`Content-Length`)
+			resp.Header.Set(`Connection`, `close`)
+		}
+		fmt.Fprintf(rw, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.Status)
+		resp.Header.Write(rw)
+		rw.WriteString("\r\n")
+		if err := rw.Flush(); err != nil {
+			conn.Close()
+			backend.Close()
+			return
+		}
+		if upgrade {
+			pipeConn(conn, rw.Reader, backend, br)
+			return
+		}
+		defer conn.Close()
+		defer backend.Close()
+		io.Copy(conn, resp.Body)
+	}()
+	return true
+}
+
+// streamRequest 根据Context构造转发给后端程序的请求
+func streamRequest(ctx Context, upgrade bool) (*http.Request, error) {
+	u, err := url.ParseRequestURI(requestURI(ctx))
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method:     requestMethod(ctx),
+		URL:        u,
+		Proto:      `HTTP/1.1`,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     requestHeaders(ctx).Clone(),
+		Host:       requestHost(ctx),
+	}
+	if len(req.Method) == 0 {
+		req.Method = http.MethodGet
+	}
+	if !upgrade {
+		req.Header.Set(`Connection`, `close`)
+	}
+	if clientIP, _, err := net.SplitHostPort(ctx.RemoteAddr()); err == nil {
+		if prior := req.Header.Get(`X-Forwarded-For`); len(prior) > 0 {
+			clientIP = prior + `, ` + clientIP
+		}
+		req.Header.Set(`X-Forwarded-For`, clientIP)
+	}
+	return req, nil
+}
+
+// pipeConn 在两个连接之间双向复制数据，任意一方关闭时结束
+func pipeConn(client net.Conn, clientBuf *bufio.Reader, backend net.Conn, backendBuf *bufio.Reader) {
+	defer client.Close()
+	defer backend.Close()
+	var src, dst io.Reader = client, backend
+	if clientBuf != nil {
+		src = clientBuf
+	}
+	if backendBuf != nil {
+		dst = backendBuf
+	}
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(backend, src)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(client, dst)
+		errc <- err
+	}()
+	<-errc
+}
+
+// drainAndClean 切换到新版本后，等待旧版本上的WebSocket/SSE连接和进行中的gRPC调用结束
+// (最多等待StreamGracePeriod)再关闭旧版本程序
+func (this *Proxy) drainAndClean() {
+	this.Gateway.CloseIdleConnections()
+	this.Gateway.WaitStreams(this.App.Port, this.App.Settings().StreamGracePeriod)
+	this.App.Clean()
+}
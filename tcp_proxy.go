@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/admpub/log"
+)
+
+// AppTypeTCP 非HTTP的TCP服务(自定义协议、Redis兼容服务等)，代理只在四层转发连接
+const AppTypeTCP = "tcp"
+
+var errTCPUnsupportedTLS = errors.New("== TLS is not supported for tcp apps")
+
+// IsTCP 是否为TCP服务
+func (this *App) IsTCP() bool {
+	return strings.ToLower(this.Type) == AppTypeTCP
+}
+
+// listenTCP 四层代理：把代理端口上的连接原样转发到当前版本的程序。
+// 切换版本后新连接转发到新版本，旧版本上已有的连接继续保持直到关闭(最多StreamGracePeriod)
+func (this *Proxy) listenTCP(router *ProxyRouter) error {
+	if this.TLS != nil {
+		return errTCPUnsupportedTLS
+	}
+	l, err := net.Listen(`tcp`, `:`+this.Port)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.Info(`== Server(TCP) Address: ` + l.Addr().String())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Error(err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go this.serveTCP(conn, router)
+	}
+}
+
+func (this *Proxy) serveTCP(conn net.Conn, router *ProxyRouter) {
+	if _, err := router.ChooseBackend(``); err != nil {
+		log.Error(err)
+		conn.Close()
+		return
+	}
+	current := this.Gateway.Backend()
+	var (
+		backend net.Conn
+		port    string
+		err     error
+	)
+	for _, port = range this.Gateway.backends(current) {
+		network, address := this.App.BackendAddress(port)
+		backend, err = net.DialTimeout(network, address, 5*time.Second)
+		if err == nil {
+			break
+		}
+		log.Warnf("== TCP backend %s: %v", port, err)
+	}
+	if backend == nil {
+		conn.Close()
+		return
+	}
+	if !this.App.Settings().DisabledLogRequest {
+		log.Info(`== Connection: ` + conn.RemoteAddr().String() + ` => ` + port)
+	}
+	done := this.Gateway.TrackStream(port)
+	defer done()
+	pipeConn(conn, nil, backend, nil)
+}
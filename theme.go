@@ -0,0 +1,141 @@
+package main
+
+import (
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/admpub/log"
+)
+
+// 各类页面的模板名称，对应模板文件夹中的“<名称>.html”
+const (
+	PageBuildError  = "build"
+	PageAppError    = "app_error"
+	PageAppDown     = "app_down"
+	PageMaintenance = "maintenance"
+
+	// 模板文件夹中没有对应页面的模板时使用
+	PageFallback = "page"
+)
+
+var (
+	// PageTheme 默认模板的配色。支持auto(跟随系统)/light/dark
+	PageTheme = "auto"
+	Pages     = NewPageTemplates("")
+)
+
+// PageTemplates 错误页面模板。模板文件被修改后会在下次渲染时自动重新载入
+type PageTemplates struct {
+	Dir   string
+	mu    sync.Mutex
+	cache map[string]*pageTemplate
+}
+
+type pageTemplate struct {
+	tmpl    *template.Template
+	file    string
+	modTime time.Time
+}
+
+func NewPageTemplates(dir string) *PageTemplates {
+	return &PageTemplates{Dir: dir, cache: map[string]*pageTemplate{}}
+}
+
+// candidates 返回页面模板文件的查找顺序
+func (this *PageTemplates) candidates(name string) []string {
+	files := []string{}
+	if len(this.Dir) > 0 {
+		files = append(files, filepath.Join(this.Dir, name+".html"))
+		if name != PageMaintenance {
+			files = append(files, filepath.Join(this.Dir, PageFallback+".html"))
+		}
+	}
+	if name != PageMaintenance {
+		// 兼容旧版本：tower所在文件夹中的page.html
+		files = append(files, filepath.Join(SelfDir(), PageFallback+".html"))
+	}
+	return files
+}
+
+// Get 返回页面模板
+func (this *PageTemplates) Get(name string) *template.Template {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, file := range this.candidates(name) {
+		fi, err := os.Stat(file)
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		cached, ok := this.cache[name]
+		if ok && cached.file == file && cached.modTime.Equal(fi.ModTime()) {
+			return cached.tmpl
+		}
+		tmpl, err := template.New(filepath.Base(file)).Funcs(pageFuncMap).ParseFiles(file)
+		if err != nil {
+			log.Error(`== Fail to parse template `+file+`: `, err)
+			break
+		}
+		if ok {
+			log.Info(`== Reload template ` + file)
+		}
+		this.cache[name] = &pageTemplate{tmpl: tmpl, file: file, modTime: fi.ModTime()}
+		return tmpl
+	}
+	return defaultPageTemplate(name)
+}
+
+var (
+	defaultPageTemplates   = map[string]*template.Template{}
+	defaultPageTemplatesMu sync.Mutex
+)
+
+func defaultPageTemplate(name string) *template.Template {
+	if name != PageMaintenance {
+		name = PageFallback
+	}
+	defaultPageTemplatesMu.Lock()
+	defer defaultPageTemplatesMu.Unlock()
+	tmpl, ok := defaultPageTemplates[name]
+	if ok {
+		return tmpl
+	}
+	content := defaultPageHTML
+	if name == PageMaintenance {
+		content = defaultMaintenanceHTML
+	}
+	tmpl = template.Must(template.New(name).Funcs(pageFuncMap).Parse(content))
+	defaultPageTemplates[name] = tmpl
+	return tmpl
+}
+
+var pageFuncMap = template.FuncMap{
+	"theme": func() string {
+		return strings.ToLower(PageTheme)
+	},
+}
+
+// AppMeta 模板中可用的应用程序信息
+type AppMeta struct {
+	Name      string    `json:"name"`
+	Version   string    `json:"version"` //可执行文件名中的版本号，例如：tower-app-1470000000 中的 1470000000
+	Port      string    `json:"port"`
+	StartTime time.Time `json:"startTime"`
+	Uptime    string    `json:"uptime"`
+}
+
+func (this *App) Meta() AppMeta {
+	meta := AppMeta{
+		Name:    this.Name,
+		Version: strings.TrimPrefix(AppBin, BinPrefix),
+		Port:    this.Port,
+	}
+	if started := this.PortStartTime(this.Port); started > 0 && this.IsRunning() {
+		meta.StartTime = time.Unix(started, 0)
+		meta.Uptime = time.Since(meta.StartTime).Truncate(time.Second).String()
+	}
+	return meta
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/admpub/log"
+)
+
+const (
+	localCACertFile = "rootCA.pem"
+	localCAKeyFile  = "rootCA-key.pem"
+	localCertFile   = "localhost.pem"
+	localKeyFile    = "localhost-key.pem"
+
+	// 证书文件的检查间隔
+	certCheckInterval = time.Second
+)
+
+// DefaultCADir 本地CA证书的保存位置
+func DefaultCADir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(SelfDir(), `.tower`, `ca`)
+	}
+	return filepath.Join(home, `.tower`, `ca`)
+}
+
+// Certificates HTTPS证书。证书文件被修改后会在下次握手时自动重新载入
+type Certificates struct {
+	CertFile string
+	KeyFile  string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	checked  time.Time
+}
+
+// NewCertificates 载入证书。certFile和keyFile为空时，使用caDir中的本地CA为hosts签发证书
+func NewCertificates(certFile string, keyFile string, hosts []string, caDir string) (*Certificates, error) {
+	if len(certFile) == 0 || len(keyFile) == 0 {
+		if len(caDir) == 0 {
+			caDir = DefaultCADir()
+		}
+		var err error
+		certFile, keyFile, err = issueLocalCert(caDir, hosts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c := &Certificates{CertFile: certFile, KeyFile: keyFile}
+	if _, err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (this *Certificates) modified() time.Time {
+	var modTime time.Time
+	for _, file := range []string{this.CertFile, this.KeyFile} {
+		if fi, err := os.Stat(file); err == nil && fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	return modTime
+}
+
+func (this *Certificates) load() (*tls.Certificate, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	now := time.Now()
+	if this.cert != nil && now.Sub(this.checked) < certCheckInterval {
+		return this.cert, nil
+	}
+	this.checked = now
+	modTime := this.modified()
+	if this.cert != nil && !modTime.After(this.modTime) {
+		return this.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(this.CertFile, this.KeyFile)
+	if err != nil {
+		if this.cert != nil {
+			// 证书可能正在写入，继续使用旧证书
+			log.Error(`== Fail to reload certificate: `, err)
+			return this.cert, nil
+		}
+		return nil, err
+	}
+	if this.cert != nil {
+		log.Info(`== Reload certificate ` + this.CertFile)
+	}
+	this.cert = &cert
+	this.modTime = modTime
+	return this.cert, nil
+}
+
+func (this *Certificates) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return this.load()
+}
+
+func (this *Certificates) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: this.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// issueLocalCert 用本地CA为hosts签发证书，CA不存在时自动生成
+func issueLocalCert(caDir string, hosts []string) (certFile string, keyFile string, err error) {
+	caCert, caKey, err := loadLocalCA(caDir)
+	if err != nil {
+		return
+	}
+	if len(hosts) == 0 {
+		hosts = []string{`localhost`}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerialNumber(),
+		Subject:      pkix.Name{Organization: []string{`Tower development certificate`}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range append(hosts, `localhost`, `127.0.0.1`, `::1`) {
+		host = strings.TrimSpace(host)
+		if len(host) == 0 {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return
+	}
+	certFile = filepath.Join(caDir, localCertFile)
+	keyFile = filepath.Join(caDir, localKeyFile)
+	if err = writePEM(certFile, `CERTIFICATE`, der, 0644); err != nil {
+		return
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+	err = writePEM(keyFile, `EC PRIVATE KEY`, keyDER, 0600)
+	log.Info(`== Issued certificate for ` + strings.Join(tmpl.DNSNames, `, `))
+	return
+}
+
+// loadLocalCA 读取本地CA，首次运行时生成。需要把rootCA.pem添加到系统或浏览器的信任列表中
+func loadLocalCA(caDir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certFile := filepath.Join(caDir, localCACertFile)
+	keyFile := filepath.Join(caDir, localCAKeyFile)
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		if err := createLocalCA(caDir); err != nil {
+			return nil, nil, err
+		}
+	}
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, errors.New(`== Invalid local CA in ` + caDir)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func createLocalCA(caDir string) error {
+	if err := os.MkdirAll(caDir, 0700); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          randomSerialNumber(),
+		Subject:               pkix.Name{Organization: []string{`Tower local CA`}, CommonName: `Tower local CA`},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err = writePEM(filepath.Join(caDir, localCAKeyFile), `EC PRIVATE KEY`, keyDER, 0600); err != nil {
+		return err
+	}
+	certFile := filepath.Join(caDir, localCACertFile)
+	if err = writePEM(certFile, `CERTIFICATE`, der, 0644); err != nil {
+		return err
+	}
+	log.Warn(`== Created local CA: ` + certFile + ` (add it to your trusted certificates)`)
+	return nil
+}
+
+func writePEM(file string, typ string, der []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), perm)
+}
+
+func randomSerialNumber() *big.Int {
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return n
+}
+
+// RedirectToHTTPS 在port上监听HTTP请求并重定向到HTTPS
+func RedirectToHTTPS(port string, httpsPort string) error {
+	log.Info(`== Redirect http://:` + port + ` to https`)
+	return http.ListenAndServe(`:`+port, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, `:`) {
+			host = `[` + host + `]`
+		}
+		if httpsPort != `443` {
+			host += `:` + httpsPort
+		}
+		http.Redirect(w, r, `https://`+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalCertificates(t *testing.T) {
+	caDir, err := ioutil.TempDir(``, `tower-ca`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(caDir)
+	certs, err := NewCertificates(``, ``, []string{`myapp.test`}, caDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(caDir, localCACertFile)); err != nil {
+		t.Fatalf("local CA should be created: %v", err)
+	}
+	cert, err := certs.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = leaf.VerifyHostname(`myapp.test`); err != nil {
+		t.Error(err)
+	}
+	if err = leaf.VerifyHostname(`127.0.0.1`); err != nil {
+		t.Error(err)
+	}
+
+	// CA已存在时重新签发，证书文件变化后自动重新载入
+	caBefore, _ := ioutil.ReadFile(filepath.Join(caDir, localCACertFile))
+	if _, _, err = issueLocalCert(caDir, []string{`other.test`}); err != nil {
+		t.Fatal(err)
+	}
+	caAfter, _ := ioutil.ReadFile(filepath.Join(caDir, localCACertFile))
+	if string(caBefore) != string(caAfter) {
+		t.Error("existing local CA should be reused")
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certs.CertFile, future, future)
+	certs.checked = time.Time{}
+	cert, _ = certs.GetCertificate(nil)
+	leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	if err = leaf.VerifyHostname(`other.test`); err != nil {
+		t.Errorf("certificate should be reloaded: %v", err)
+	}
+}
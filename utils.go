@@ -29,6 +29,10 @@ func SelfDir() string {
 }
 
 func dialAddress(address string, timeOut int, args ...func() bool) (err error) {
+	return dialNetwork("tcp", address, timeOut, args...)
+}
+
+func dialNetwork(network string, address string, timeOut int, args ...func() bool) (err error) {
 	seconds := 0
 	var fn func() bool
 	if len(args) > 0 {
@@ -37,7 +41,7 @@ func dialAddress(address string, timeOut int, args ...func() bool) (err error) {
 	for {
 		select {
 		case <-time.After(1 * time.Second):
-			conn, err := net.Dial("tcp", address)
+			conn, err := net.Dial(network, address)
 			if err == nil {
 				conn.Close()
 				return err
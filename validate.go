@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/webx-top/tower/config"
+)
+
+var logLevels = []string{`Debug`, `Info`, `Warn`, `Error`, `Fatal`}
+
+// ConfigError 配置文件中的一个错误
+type ConfigError struct {
+	File    string
+	Line    int    //为0时表示该设置不是来自配置文件
+	Key     string //例如：app.port
+	Source  string //设置的来源，例如：“env TOWER_APP_PORT”、“flag -p”
+	Message string
+}
+
+func (this *ConfigError) Error() string {
+	if len(this.Key) == 0 {
+		// 配置文件的语法错误等
+		if this.Line > 0 {
+			return fmt.Sprintf("%s:%d: %s", this.File, this.Line, this.Message)
+		}
+		return this.File + `: ` + this.Message
+	}
+	if this.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s: %s", this.File, this.Line, this.Key, this.Message)
+	}
+	if len(this.Source) > 0 && this.Source != config.SourceDefault {
+		return this.Key + ` (` + this.Source + `): ` + this.Message
+	}
+	return this.Key + `: ` + this.Message
+}
+
+// ConfigValidator 检查配置，收集所有错误而不是遇到第一个错误就停止
+type ConfigValidator struct {
+	File    string
+	Build   bool //是否为编译模式
+	format  string
+	content []byte
+	conf    *config.Config
+	Errors  []*ConfigError
+}
+
+func NewConfigValidator(file string, build bool) *ConfigValidator {
+	content, _ := ioutil.ReadFile(file)
+	return &ConfigValidator{File: file, Build: build, format: DetectConfigFormat(file, content), content: content}
+}
+
+func (this *ConfigValidator) addError(key string, format string, args ...interface{}) {
+	err := &ConfigError{
+		File:    this.File,
+		Key:     key,
+		Source:  this.conf.Source(key),
+		Message: fmt.Sprintf(format, args...),
+	}
+	// 被环境变量或命令行参数覆盖的设置不指向配置文件中的行
+	if !strings.HasPrefix(err.Source, config.SourceEnv) && !strings.HasPrefix(err.Source, config.SourceFlag) {
+		err.Line = this.keyLine(key)
+	}
+	this.Errors = append(this.Errors, err)
+}
+
+// Validate 检查conf，返回所有错误
+func (this *ConfigValidator) Validate(conf *config.Config) []*ConfigError {
+	this.conf = conf
+	app, proxy := conf.App, conf.Proxy
+	if this.Build {
+		if len(*app.MainFile) > 0 && !fileExist(*app.MainFile) {
+			this.addError(`app.main`, `file %q does not exist`, *app.MainFile)
+		}
+	} else if len(*app.ExecFile) == 0 {
+		this.addError(`app.exec`, `must be set to the app's executable file when not in the compile mode`)
+	}
+	if len(*app.SocketDir) == 0 {
+		if err := validatePortRange(*app.Port); err != nil {
+			this.addError(`app.port`, `%v`, err)
+		}
+	}
+	switch strings.ToLower(*app.Type) {
+	case AppTypeHTTP, AppTypeGRPC, AppTypeTCP:
+	default:
+		this.addError(`app.type`, `unsupported type %q (http, grpc or tcp)`, *app.Type)
+	}
+	if _, err := splitShellWords(*app.RunParams); err != nil {
+		this.addError(`app.params`, `%v`, strings.TrimPrefix(err.Error(), `== `))
+	}
+	if _, err := ParseSignal(*app.StopSignal); err != nil {
+		this.addError(`app.stopSignal`, `%v`, strings.TrimPrefix(err.Error(), `== `))
+	}
+	if *app.StopTimeout < 0 {
+		this.addError(`app.stopTimeout`, `must not be negative`)
+	}
+	if len(*app.ConfigTemplate) > 0 && !fileExist(*app.ConfigTemplate) {
+		this.addError(`app.configTemplate`, `file %q does not exist`, *app.ConfigTemplate)
+	}
+	if _, err := LoadAppEnv(*app.EnvFile, nil); err != nil {
+		this.addError(`app.envFile`, `%v`, err)
+	}
+	if len(*app.WorkDir) > 0 {
+		if fi, err := os.Stat(*app.WorkDir); err != nil || !fi.IsDir() {
+			this.addError(`app.workDir`, `directory %q does not exist`, *app.WorkDir)
+		}
+	}
+
+	if len(*proxy.Port) > 0 {
+		if err := validatePort(*proxy.Port); err != nil {
+			this.addError(`proxy.port`, `%v`, err)
+		}
+	}
+	features := []string{}
+	if *proxy.TLS.Enabled {
+		features = append(features, FeatureTLS)
+		if *proxy.HTTP2 {
+			features = append(features, FeatureHTTP2)
+		}
+		if strings.ToLower(*app.Type) == AppTypeTCP {
+			this.addError(`proxy.tls.enabled`, `TLS is not supported for tcp apps`)
+		}
+		if (len(*proxy.TLS.CertFile) == 0) != (len(*proxy.TLS.KeyFile) == 0) {
+			this.addError(`proxy.tls.certFile`, `certFile and keyFile must be set together`)
+		}
+		for key, file := range map[string]string{`proxy.tls.certFile`: *proxy.TLS.CertFile, `proxy.tls.keyFile`: *proxy.TLS.KeyFile} {
+			if len(file) > 0 && !fileExist(file) {
+				this.addError(key, `file %q does not exist`, file)
+			}
+		}
+		if len(*proxy.TLS.RedirectPort) > 0 {
+			if err := validatePort(*proxy.TLS.RedirectPort); err != nil {
+				this.addError(`proxy.tls.redirectPort`, `%v`, err)
+			}
+		}
+	} else if *proxy.H2C {
+		features = append(features, FeatureH2C)
+	}
+	if strings.ToLower(*app.Type) == AppTypeGRPC {
+		features = append(features, FeatureGRPC)
+	}
+	if strings.ToLower(*app.Type) != AppTypeTCP {
+		if err := ValidateEngine(*proxy.Engine, features...); err != nil {
+			this.addError(`proxy.engine`, `%v`, strings.TrimPrefix(err.Error(), `== `))
+		}
+	}
+	for _, code := range strings.Split(*proxy.RetryStatusCodes, `,`) {
+		code = strings.TrimSpace(code)
+		if len(code) == 0 {
+			continue
+		}
+		if i, err := strconv.Atoi(code); err != nil || i < 100 || i > 599 {
+			this.addError(`proxy.retryStatusCodes`, `invalid status code %q`, code)
+		}
+	}
+	for key, value := range map[string]int{
+		`proxy.retries`:           *proxy.Retries,
+		`proxy.retryTimeout`:      *proxy.RetryTimeout,
+		`proxy.queueSize`:         *proxy.QueueSize,
+		`proxy.queueTimeout`:      *proxy.QueueTimeout,
+		`proxy.streamGracePeriod`: *proxy.StreamGracePeriod,
+		`maintenance.retryAfter`:  *conf.Maintenance.RetryAfter,
+	} {
+		if value < 0 {
+			this.addError(key, `must not be negative`)
+		}
+	}
+
+	if _, err := regexp.Compile(`\.(` + *conf.Watch.FileExtension + `)$`); err != nil {
+		this.addError(`watch.fileExtension`, `invalid regexp: %v`, err)
+	}
+	if _, err := regexp.Compile(*conf.Watch.IgnoredPath); err != nil {
+		this.addError(`watch.ignoredPath`, `invalid regexp: %v`, err)
+	}
+
+	validLevel := false
+	for _, level := range logLevels {
+		if strings.EqualFold(level, *conf.LogLevel) {
+			validLevel = true
+		}
+	}
+	if !validLevel {
+		this.addError(`logLevel`, `unsupported level %q (%s)`, *conf.LogLevel, strings.Join(logLevels, `/`))
+	}
+	sort.SliceStable(this.Errors, func(i, j int) bool {
+		if this.Errors[i].Line != this.Errors[j].Line {
+			return this.Errors[i].Line < this.Errors[j].Line
+		}
+		return this.Errors[i].Key < this.Errors[j].Key
+	})
+	return this.Errors
+}
+
+var configErrorLineRegex = regexp.MustCompile(`(?i)\bline (\d+)`)
+
+// configFileError 把读取配置文件时的错误(语法错误等)转换为ConfigError，并尽量找出行号。
+// confl、YAML和TOML的错误信息中带有行号，JSON则根据出错的位置计算
+func configFileError(file string, content []byte, err error) error {
+	if err == nil || err == errOldConfigFormat {
+		return err
+	}
+	e := &ConfigError{File: file, Message: err.Error()}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case DetectConfigFormat(file, content) != FormatJSON:
+		if m := configErrorLineRegex.FindStringSubmatch(e.Message); m != nil {
+			e.Line, _ = strconv.Atoi(m[1])
+		}
+	case errors.As(err, &syntaxErr):
+		e.Line = offsetLine(content, syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		e.Line = offsetLine(content, typeErr.Offset)
+	}
+	return e
+}
+
+// offsetLine 返回content中第offset个字节所在的行号
+func offsetLine(content []byte, offset int64) int {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	return bytes.Count(content[:offset], []byte("\n")) + 1
+}
+
+// ValidateConfig 检查conf，把所有错误合并为一个错误返回
+func ValidateConfig(file string, build bool, conf *config.Config) error {
+	errs := NewConfigValidator(file, build).Validate(conf)
+	if len(errs) == 0 {
+		return nil
+	}
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return errors.New(strings.Join(messages, "\n"))
+}
+
+// validatePort 检查端口号
+func validatePort(port string) error {
+	i, err := strconv.Atoi(strings.TrimSpace(port))
+	if err != nil || i < 1 || i > 65535 {
+		return fmt.Errorf(`invalid port %q`, port)
+	}
+	return nil
+}
+
+// validatePortRange 检查ParseMutiPort支持的端口列表，例如：“5001,5003,5050-5060”
+func validatePortRange(ports string) error {
+	if len(ports) == 0 {
+		return nil
+	}
+	for _, v := range strings.Split(ports, `,`) {
+		r := strings.Split(v, `-`)
+		if len(r) > 2 {
+			return fmt.Errorf(`invalid port range %q`, v)
+		}
+		for _, port := range r {
+			if err := validatePort(port); err != nil {
+				return err
+			}
+		}
+		if len(r) == 2 {
+			i, _ := strconv.Atoi(strings.TrimSpace(r[0]))
+			j, _ := strconv.Atoi(strings.TrimSpace(r[1]))
+			if i > j {
+				return fmt.Errorf(`invalid port range %q`, v)
+			}
+		}
+	}
+	return nil
+}
+
+// keyLine 返回key在配置文件中所在的行，找不到时返回0
+func (this *ConfigValidator) keyLine(key string) int {
+	switch this.format {
+	case FormatYAML:
+		return yamlKeyLine(this.content, key)
+	case FormatTOML:
+		return tomlKeyLine(this.content, key)
+	default:
+		return configKeyLine(this.content, key)
+	}
+}
+
+var (
+	configKeyRegex = regexp.MustCompile(`^\s*"?([\w.-]+)"?\s*([:={])`)
+	yamlKeyRegex   = regexp.MustCompile(`^["']?([\w.-]+)["']?\s*:(\s+|$)(.*)$`)
+	tomlKeyRegex   = regexp.MustCompile(`^["']?([\w.-]+)["']?\s*=`)
+)
+
+// configKeyLine 返回key(例如“proxy.tls.certFile”)在confl或JSON格式的配置文件中所在的行，找不到时返回0
+func configKeyLine(content []byte, key string) int {
+	var sections []string
+	for i, line := range strings.Split(string(content), "\n") {
+		if pos := strings.Index(line, `#`); pos >= 0 {
+			line = line[:pos]
+		}
+		line = strings.TrimSpace(line)
+		if matches := configKeyRegex.FindStringSubmatch(line); matches != nil {
+			path := append(sections[:len(sections):len(sections)], matches[1])
+			if strings.Join(path, `.`) == key {
+				return i + 1
+			}
+			if strings.HasSuffix(line, `{`) {
+				sections = path
+			}
+			continue
+		}
+		if strings.HasPrefix(line, `}`) && len(sections) > 0 {
+			sections = sections[:len(sections)-1]
+		}
+	}
+	return 0
+}
+
+// yamlKeyLine 与configKeyLine相同，用于YAML格式(用缩进表示分组)
+func yamlKeyLine(content []byte, key string) int {
+	var (
+		sections []string
+		indents  []int
+	)
+	for i, line := range strings.Split(string(content), "\n") {
+		if pos := strings.Index(line, ` #`); pos >= 0 {
+			line = line[:pos]
+		}
+		trimmed := strings.TrimSpace(line)
+		if len(trimmed) == 0 || strings.HasPrefix(trimmed, `#`) {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		for len(indents) > 0 && indents[len(indents)-1] >= indent {
+			sections, indents = sections[:len(sections)-1], indents[:len(indents)-1]
+		}
+		matches := yamlKeyRegex.FindStringSubmatch(trimmed)
+		if matches == nil {
+			continue
+		}
+		path := append(sections[:len(sections):len(sections)], matches[1])
+		if strings.Join(path, `.`) == key {
+			return i + 1
+		}
+		if len(strings.TrimSpace(matches[3])) == 0 {
+			sections, indents = path, append(indents, indent)
+		}
+	}
+	return 0
+}
+
+// tomlKeyLine 与configKeyLine相同，用于TOML格式(用“[section]”表示分组)
+func tomlKeyLine(content []byte, key string) int {
+	var section string
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if matches := tomlTableRegex.FindStringSubmatch(line); matches != nil {
+			section = matches[1]
+			if section == key {
+				return i + 1
+			}
+			continue
+		}
+		if matches := tomlKeyRegex.FindStringSubmatch(line); matches != nil {
+			path := matches[1]
+			if len(section) > 0 {
+				path = section + `.` + path
+			}
+			if path == key {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/webx-top/tower/config"
+)
+
+func TestConfigKeyLine(t *testing.T) {
+	content := []byte(`app {
+  # port : "1"
+  port : "5001-5050"
+  env {}
+}
+
+proxy {
+  port : "8080"
+  tls {
+    certFile : ""
+  }
+}
+logLevel : "Debug"
+`)
+	for key, line := range map[string]int{`app.port`: 3, `proxy.port`: 8, `proxy.tls.certFile`: 10, `logLevel`: 13, `app.main`: 0} {
+		if n := configKeyLine(content, key); n != line {
+			t.Errorf("%s: expected line %d, got %d", key, line, n)
+		}
+	}
+}
+
+func TestYAMLAndTOMLKeyLine(t *testing.T) {
+	yaml := []byte(`app:
+  # port: "1"
+  port: "5001-5050"
+  env: {}
+proxy:
+  port: "8080" # comment
+  tls:
+    certFile: ""
+logLevel: Debug
+`)
+	toml := []byte(`logLevel = "Debug"
+
+[app]
+port = "5001-5050"
+
+[proxy.tls]
+certFile = ""
+`)
+	for key, line := range map[string]int{`app.port`: 3, `proxy.port`: 6, `proxy.tls.certFile`: 8, `logLevel`: 9, `app.main`: 0} {
+		if n := yamlKeyLine(yaml, key); n != line {
+			t.Errorf("yaml %s: expected line %d, got %d", key, line, n)
+		}
+	}
+	for key, line := range map[string]int{`app.port`: 4, `proxy.tls.certFile`: 7, `logLevel`: 1, `proxy.port`: 0} {
+		if n := tomlKeyLine(toml, key); n != line {
+			t.Errorf("toml %s: expected line %d, got %d", key, line, n)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `tower-check`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, `tower.yml`)
+	content := "app {\n  port : \"5001-abc\"\n  stopSignal : \"SIGFOO\"\n}\nwatch {\n  ignoredPath : \"(\"\n}\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf := &config.Config{}
+	conf.Fixed()
+	*conf.App.Port = `5001-abc`
+	*conf.App.StopSignal = `SIGFOO`
+	*conf.Watch.IgnoredPath = `(`
+	*conf.LogLevel = `Debug`
+	errs := NewConfigValidator(file, true).Validate(conf)
+	keys := []string{`app.port`, `app.stopSignal`, `watch.ignoredPath`}
+	lines := []int{2, 3, 6}
+	if len(errs) != len(keys) {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	for i, err := range errs {
+		if err.Key != keys[i] || err.Line != lines[i] {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	conf.Set(`app.port`, `5001-abc`, config.SourceFlag+` -p`)
+	errs = NewConfigValidator(file, true).Validate(conf)
+	if len(errs) == 0 || errs[0].Key != `app.port` || errs[0].Line != 0 || errs[0].Error() != `app.port (flag -p): invalid port "abc"` {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	*conf.App.Port = `5001-5050`
+	*conf.App.StopSignal = `SIGTERM`
+	*conf.Watch.IgnoredPath = ``
+	if err := ValidateConfig(file, true, conf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigFileError(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `tower`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		`tower.yml`:  "app:\n  port: \"5001\"\n  env: [\n",
+		`tower.json`: "{\n  \"app\": {\n    \"port\": 5001\n  }\n}\n",
+		`tower.toml`: "[app]\nport = \"5001\"\n\n[proxy\n",
+	} {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		err := decodeConfigFile(file, config.New())
+		e, ok := err.(*ConfigError)
+		if !ok || e.Line < 2 || e.File != file {
+			t.Fatalf("%s: expected an error with the line number, got %v", name, err)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/admpub/log"
@@ -30,6 +31,9 @@ type Watcher struct {
 	IgnoredPathPattern string
 	OnlyWatchBin       bool
 	Paused             bool
+	fileReg            *regexp.Regexp
+	watchedDirs        map[string]bool //已经在监控的目录，为nil时还没有开始监控
+	mu                 sync.Mutex
 }
 
 func NewWatcher(dir, filePattern, ignoredPathPattern string) (w Watcher) {
@@ -53,17 +57,12 @@ func NewWatcher(dir, filePattern, ignoredPathPattern string) (w Watcher) {
 }
 
 func (this *Watcher) Watch() (err error) {
-	for _, dir := range this.dirsToWatch() {
-		err = this.Watcher.Watch(dir)
-		if err != nil {
-			return
-		}
+	if err = this.SetPatterns(this.patterns()); err != nil {
+		return
 	}
-	filePattern := `\.(` + this.FilePattern + `)$`
-	if this.OnlyWatchBin {
-		filePattern = regexp.QuoteMeta(BinPrefix) + `[\d]+(\.exe)?$`
+	if err = this.watchDirs(); err != nil {
+		return
 	}
-	expectedFileReg := regexp.MustCompile(filePattern)
 	for {
 		select {
 		case file := <-this.Watcher.Event:
@@ -75,7 +74,7 @@ func (this *Watcher) Watch() (err error) {
 			if checkTMPFile(file.Name) {
 				continue
 			}
-			if expectedFileReg.Match([]byte(file.Name)) == false {
+			if this.fileRegexp().Match([]byte(file.Name)) == false {
 				if this.OnlyWatchBin {
 					log.Info("== [IGNORE]", file.Name)
 				}
@@ -111,8 +110,93 @@ func (this *Watcher) Watch() (err error) {
 	return nil
 }
 
+// compileWatchPatterns 检查并编译监控的文件扩展名和忽略的路径
+func compileWatchPatterns(filePattern, ignoredPathPattern string) (*regexp.Regexp, *regexp.Regexp, error) {
+	if len(filePattern) == 0 {
+		filePattern = DefaultWatchedFiles
+	}
+	if len(ignoredPathPattern) == 0 {
+		ignoredPathPattern = DefaultIngoredPaths
+	}
+	fileReg, err := regexp.Compile(`\.(` + filePattern + `)$`)
+	if err != nil {
+		return nil, nil, err
+	}
+	ignoredPathReg, err := regexp.Compile(ignoredPathPattern)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fileReg, ignoredPathReg, nil
+}
+
+// SetPatterns 修改监控的文件扩展名和忽略的路径，正在监控时会重新确定需要监控的目录
+func (this *Watcher) SetPatterns(filePattern, ignoredPathPattern string) error {
+	fileReg, _, err := compileWatchPatterns(filePattern, ignoredPathPattern)
+	if err != nil {
+		return err
+	}
+	if this.OnlyWatchBin {
+		fileReg = regexp.MustCompile(regexp.QuoteMeta(BinPrefix) + `[\d]+(\.exe)?$`)
+	}
+	if len(filePattern) == 0 {
+		filePattern = DefaultWatchedFiles
+	}
+	if len(ignoredPathPattern) == 0 {
+		ignoredPathPattern = DefaultIngoredPaths
+	}
+	this.mu.Lock()
+	this.FilePattern = filePattern
+	this.IgnoredPathPattern = ignoredPathPattern
+	this.fileReg = fileReg
+	watching := this.watchedDirs != nil
+	this.mu.Unlock()
+	if watching {
+		return this.watchDirs()
+	}
+	return nil
+}
+
+// patterns 返回当前的FilePattern和IgnoredPathPattern，它们可能被重新载入配置时调用的SetPatterns修改
+func (this *Watcher) patterns() (filePattern string, ignoredPathPattern string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.FilePattern, this.IgnoredPathPattern
+}
+
+func (this *Watcher) fileRegexp() *regexp.Regexp {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.fileReg
+}
+
+// watchDirs 开始监控新增的目录，不再监控已被忽略的目录
+func (this *Watcher) watchDirs() error {
+	dirs := map[string]bool{}
+	for _, dir := range this.dirsToWatch() {
+		dirs[dir] = true
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for dir := range dirs {
+		if this.watchedDirs[dir] {
+			continue
+		}
+		if err := this.Watcher.Watch(dir); err != nil {
+			return err
+		}
+	}
+	for dir := range this.watchedDirs {
+		if !dirs[dir] {
+			this.Watcher.RemoveWatch(dir)
+		}
+	}
+	this.watchedDirs = dirs
+	return nil
+}
+
 func (this *Watcher) dirsToWatch() (dirs []string) {
-	ignoredPathReg := regexp.MustCompile(this.IgnoredPathPattern)
+	_, ignoredPathPattern := this.patterns()
+	ignoredPathReg := regexp.MustCompile(ignoredPathPattern)
 	matchedDirs := make(map[string]bool)
 	dir, _ := filepath.Abs("./")
 	matchedDirs[dir] = true